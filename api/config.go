@@ -21,6 +21,7 @@ type (
 		SMTPPassword         string `env:"SMTP_PASSWORD"`
 		EmailSenderName      string `env:"EMAIL_SENDER_NAME"`
 		EmailConfirmationURL string `env:"EMAIL_CONFIRMATION_URL"`
+		PasswordResetURL     string `env:"PASSWORD_RESET_URL"`
 		CloudinaryCloudName  string `env:"CLOUDINARY_CLOUD_NAME"`
 		CloudinaryAPIKey     string `env:"CLOUDINARY_API_KEY"`
 		CloudinaryAPISecret  string `env:"CLOUDINARY_API_SECRET"`
@@ -48,4 +49,6 @@ func LoadAppConfig() {
 		osEnv := os.Getenv(tag)
 		reflect.ValueOf(&AppConfig).Elem().FieldByName(field.Name).SetString(osEnv)
 	}
+
+	JwtSecretKey = []byte(AppConfig.JwtSecret)
 }
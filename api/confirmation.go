@@ -0,0 +1,121 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	ResendConfirmationInput struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+)
+
+var (
+	ErrAccountNotConfirmed = errors.New("account is not confirmed yet")
+	ErrTooManyRequests     = errors.New("too many requests, please try again later")
+)
+
+var (
+	// time to wait between two confirmation emails to the same address
+	ResendConfirmationCooldown = time.Duration(1) * time.Minute
+	// confirmation emails an address can get within ResendConfirmationWindow
+	ResendConfirmationLimit  int64 = 5
+	ResendConfirmationWindow       = time.Duration(1) * time.Hour
+)
+
+func resendConfirmationCooldownKey(email string) string {
+	return fmt.Sprintf("email_confirmation_resend:cooldown:%s", email)
+}
+
+func resendConfirmationCountKey(email string) string {
+	return fmt.Sprintf("email_confirmation_resend:count:%s", email)
+}
+
+// allowConfirmationResend applies the rate limit of the address. Unknown
+// addresses are limited the same way, so the limit doesn't tell them apart
+// from registered ones.
+func allowConfirmationResend(email string) error {
+	ok, err := RedisClient.SetNX(context.Background(), resendConfirmationCooldownKey(email), 1, ResendConfirmationCooldown).Result()
+	if err != nil {
+		return fmt.Errorf("[allowConfirmationResend] %v", err)
+	}
+	if !ok {
+		return ErrTooManyRequests
+	}
+
+	countKey := resendConfirmationCountKey(email)
+	pipe := RedisClient.TxPipeline()
+	count := pipe.Incr(context.Background(), countKey)
+	pipe.ExpireNX(context.Background(), countKey, ResendConfirmationWindow)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return fmt.Errorf("[allowConfirmationResend] %v", err)
+	}
+	if count.Val() > ResendConfirmationLimit {
+		return ErrTooManyRequests
+	}
+
+	return nil
+}
+
+// ResendConfirmation sends a new confirmation email to an account that isn't
+// confirmed yet. It succeeds without sending anything for addresses that are
+// unknown or already confirmed.
+func ResendConfirmation(input ResendConfirmationInput) error {
+	email := normalizeEmail(input.Email)
+	if err := allowConfirmationResend(email); err != nil {
+		return err
+	}
+
+	user, err := FindUserByEmail(email)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[ResendConfirmation] %v", err)
+	}
+
+	if user.Status != Inactive {
+		return nil
+	}
+
+	if err := sendConfirmationToken(user); err != nil {
+		return fmt.Errorf("[ResendConfirmation] %v", err)
+	}
+
+	return nil
+}
+
+func (f *UserFunc) ResendConfirmationHandler(ctx *gin.Context) {
+	input := ResendConfirmationInput{}
+	if err := ctx.ShouldBind(&input); err != nil || input.Email == "" {
+		log.Printf("[ResendConfirmationHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to resend confirmation email, please check your request data",
+		})
+		return
+	}
+
+	if err := f.ResendConfirmationFunc(input); err != nil {
+		log.Printf("[ResendConfirmationHandler] %v", err)
+		if err == ErrTooManyRequests {
+			ctx.JSON(429, gin.H{
+				"status":  "error",
+				"message": "Too many confirmation emails requested, please try again later",
+			})
+			return
+		}
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "If the account needs to be confirmed, a new confirmation email has been sent",
+	})
+}
@@ -0,0 +1,113 @@
+package api
+
+import "encoding/json"
+
+type (
+	EventType string
+
+	// Event is the envelope of every frame exchanged over the websocket. The
+	// client picks the nonce, the server echoes it back on the ack or error
+	// reply to the request carrying it.
+	Event struct {
+		ID      string      `json:"id,omitempty"`
+		Version int         `json:"v"`
+		Type    EventType   `json:"type"`
+		Payload interface{} `json:"payload,omitempty"`
+		Nonce   string      `json:"nonce,omitempty"`
+		Error   *EventError `json:"error,omitempty"`
+	}
+
+	// IncomingEvent is an event sent by the client, the payload is decoded
+	// once the type is known.
+	IncomingEvent struct {
+		Version int             `json:"v"`
+		Type    EventType       `json:"type"`
+		Payload json.RawMessage `json:"payload"`
+		Nonce   string          `json:"nonce"`
+	}
+
+	EventError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+
+	RoomEventPayload struct {
+		Room    *Room    `json:"room"`
+		ActorID string   `json:"actorId"`
+		UserIDs []string `json:"userIds,omitempty"`
+	}
+)
+
+const (
+	EventVersion = 1
+
+	// events sent by the server
+	Ack                    EventType = "ack"
+	Error                  EventType = "error"
+	RoomCreated            EventType = "room.created"
+	RoomUpdated            EventType = "room.updated"
+	RoomMemberAdded        EventType = "room.member_added"
+	RoomMemberRemoved      EventType = "room.member_removed"
+	RoomMemberLeft         EventType = "room.member_left"
+	RoomRead               EventType = "room.read"
+	RoomPreferencesUpdated EventType = "room.preferences_updated"
+	MessageCreated         EventType = "message.created"
+	MessageUpdated         EventType = "message.updated"
+	MessageDeleted         EventType = "message.deleted"
+	MessageStatusChanged   EventType = "message.status"
+	MessageThreadUpdated   EventType = "message.thread_updated"
+	MessagePinned          EventType = "message.pinned"
+	MessageUnpinned        EventType = "message.unpinned"
+	ReactionAdded          EventType = "reaction.added"
+	ReactionRemoved        EventType = "reaction.removed"
+	TypingStarted          EventType = "typing.started"
+	TypingStopped          EventType = "typing.stopped"
+	TypingState            EventType = "typing.state"
+	PresenceChanged        EventType = "presence.changed"
+	SyncReset              EventType = "sync.reset"
+	SyncDone               EventType = "sync.done"
+
+	// events sent by the client
+	MessageSend    EventType = "message.send"
+	MessageEdit    EventType = "message.edit"
+	MessageDelete  EventType = "message.delete"
+	TypingStart    EventType = "typing.start"
+	TypingStop     EventType = "typing.stop"
+	RoomMarkRead   EventType = "room.mark_read"
+	ReactionAdd    EventType = "reaction.add"
+	ReactionRemove EventType = "reaction.remove"
+)
+
+func NewEvent(eventType EventType, payload interface{}) Event {
+	return Event{
+		Version: EventVersion,
+		Type:    eventType,
+		Payload: payload,
+	}
+}
+
+func NewAckEvent(nonce string, payload interface{}) Event {
+	event := NewEvent(Ack, payload)
+	event.Nonce = nonce
+	return event
+}
+
+func NewErrorEvent(nonce, code, message string) Event {
+	event := NewEvent(Error, nil)
+	event.Nonce = nonce
+	event.Error = &EventError{
+		Code:    code,
+		Message: message,
+	}
+	return event
+}
+
+func SendEvent(roomID string, userIDs []string, event Event) {
+	wsHub.Publish(roomID, userIDs, event)
+}
+
+// SendUserEvent sends the event to every session of the listed users, no
+// matter which room the session is opened in.
+func SendUserEvent(userIDs []string, event Event) {
+	wsHub.PublishToUsers(userIDs, event)
+}
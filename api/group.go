@@ -0,0 +1,703 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	UpdateRoomInput struct {
+		Name string `json:"name"`
+	}
+
+	AddParticipantsInput struct {
+		UserIDs []string `json:"userIds"`
+	}
+
+	UpdateParticipantRoleInput struct {
+		Role ParticipantRole `json:"role"`
+	}
+
+	TransferOwnershipInput struct {
+		UserID string `json:"userId"`
+	}
+)
+
+func CreateGroupRoom(user *User, input CreateRoomInput) (CreateRoomOutput, error) {
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return CreateRoomOutput{}, ErrGroupNameRequired
+	}
+
+	owner := NewParticipant(user)
+	owner.Role = Owner
+	participants := []Participant{owner}
+
+	memberIDs := make([]string, 0, len(input.ParticipantIDs))
+	for _, id := range input.ParticipantIDs {
+		if id != user.ID.Hex() {
+			memberIDs = append(memberIDs, id)
+		}
+	}
+
+	if len(memberIDs) != 0 {
+		members, err := FindUsersByIDs(memberIDs)
+		if err != nil {
+			return CreateRoomOutput{}, err
+		}
+
+		for i := range members {
+			participant := NewParticipant(&members[i])
+			participant.Role = Member
+			participants = append(participants, participant)
+		}
+	}
+
+	room := &Room{
+		Participants: participants,
+		RoomType:     Group,
+		Name:         name,
+	}
+	if err := room.Save(); err != nil {
+		return CreateRoomOutput{}, fmt.Errorf("[CreateGroupRoom] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), room.ParticipantIDs(), NewEvent(RoomCreated, RoomEventPayload{
+		Room:    room,
+		ActorID: user.ID.Hex(),
+	}))
+
+	return CreateRoomOutput{
+		Room:    room,
+		Created: true,
+	}, nil
+}
+
+// findGroupRoomForMember loads a group room and the participant entry of the
+// user, failing when the room is private or the user isn't a member.
+func findGroupRoomForMember(roomID string, userID primitive.ObjectID) (*Room, *Participant, error) {
+	room, err := FindRoomByID(roomID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if room.RoomType != Group {
+		return nil, nil, ErrNotGroupRoom
+	}
+
+	participant := room.FindParticipant(userID)
+	if participant == nil {
+		return nil, nil, ErrNotRoomParticipant
+	}
+
+	return room, participant, nil
+}
+
+// participantWithRole matches rooms where the participant holds a role that
+// passes the role condition, so the write fails when the role changed since
+// it was read.
+func participantWithRole(id primitive.ObjectID, role interface{}) bson.M {
+	return bson.M{
+		"participants": bson.M{"$elemMatch": bson.M{"id": id, "role": role}},
+	}
+}
+
+func updateGroupRoom(roomID primitive.ObjectID, filter bson.M, update bson.M, opts ...*options.UpdateOptions) error {
+	filter["_id"] = roomID
+	if set, ok := update["$set"].(bson.M); ok {
+		set["updatedAt"] = time.Now()
+	} else {
+		update["$set"] = bson.M{"updatedAt": time.Now()}
+	}
+
+	res, err := MongoDatabase.Collection(rooms).UpdateOne(context.Background(), filter, update, opts...)
+	if err != nil {
+		return fmt.Errorf("[updateGroupRoom] %v", err)
+	}
+
+	// the guard in the filter no longer holds, another request changed the
+	// membership between our read and this write
+	if res.MatchedCount == 0 {
+		return ErrRoomPermission
+	}
+
+	return nil
+}
+
+func UpdateRoom(user *User, roomID string, input UpdateRoomInput) (*Room, error) {
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return nil, ErrGroupNameRequired
+	}
+
+	room, participant, err := findGroupRoomForMember(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !participant.CanManageMembers() {
+		return nil, ErrRoomPermission
+	}
+
+	filter := participantWithRole(user.ID, bson.M{"$in": bson.A{Owner, Admin}})
+	err = updateGroupRoom(room.ID, filter, bson.M{"$set": bson.M{"name": name}})
+	if err != nil {
+		return nil, err
+	}
+
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("[UpdateRoom] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), room.ParticipantIDs(), NewEvent(RoomUpdated, RoomEventPayload{
+		Room:    room,
+		ActorID: user.ID.Hex(),
+	}))
+
+	return room, nil
+}
+
+func AddParticipants(user *User, roomID string, input AddParticipantsInput) (*Room, error) {
+	room, participant, err := findGroupRoomForMember(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !participant.CanManageMembers() {
+		return nil, ErrRoomPermission
+	}
+
+	newIDs := make([]string, 0, len(input.UserIDs))
+	for _, id := range input.UserIDs {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return nil, err
+		}
+
+		if room.FindParticipant(objID) == nil {
+			newIDs = append(newIDs, id)
+		}
+	}
+
+	if len(newIDs) == 0 {
+		return room, nil
+	}
+
+	newUsers, err := FindUsersByIDs(newIDs)
+	if err != nil {
+		return nil, fmt.Errorf("[AddParticipants] %v", err)
+	}
+
+	newParticipants := make([]Participant, 0, len(newUsers))
+	newObjIDs := make([]primitive.ObjectID, 0, len(newUsers))
+	addedIDs := make([]string, 0, len(newUsers))
+	for i := range newUsers {
+		participant := NewParticipant(&newUsers[i])
+		participant.Role = Member
+		newParticipants = append(newParticipants, participant)
+		newObjIDs = append(newObjIDs, participant.ID)
+		addedIDs = append(addedIDs, participant.ID.Hex())
+	}
+
+	if len(newParticipants) == 0 {
+		return room, nil
+	}
+
+	filter := participantWithRole(user.ID, bson.M{"$in": bson.A{Owner, Admin}})
+	filter["participants.id"] = bson.M{"$nin": newObjIDs}
+	update := bson.M{
+		"$push": bson.M{"participants": bson.M{"$each": newParticipants}},
+	}
+	if err := updateGroupRoom(room.ID, filter, update); err != nil {
+		return nil, err
+	}
+
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("[AddParticipants] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), room.ParticipantIDs(), NewEvent(RoomMemberAdded, RoomEventPayload{
+		Room:    room,
+		ActorID: user.ID.Hex(),
+		UserIDs: addedIDs,
+	}))
+
+	return room, nil
+}
+
+func RemoveParticipant(user *User, roomID, participantID string) (*Room, error) {
+	targetID, err := primitive.ObjectIDFromHex(participantID)
+	if err != nil {
+		return nil, err
+	}
+
+	room, participant, err := findGroupRoomForMember(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if !participant.CanManageMembers() {
+		return nil, ErrRoomPermission
+	}
+
+	target := room.FindParticipant(targetID)
+	if target == nil {
+		return nil, ErrParticipantNotFound
+	}
+
+	// admins can only remove members, the owner has to be transferred first
+	// and only the owner is able to remove other admins
+	if target.Role == Owner || (target.Role == Admin && participant.Role != Owner) {
+		return nil, ErrRoomPermission
+	}
+
+	protected := bson.A{Owner}
+	if participant.Role != Owner {
+		protected = append(protected, Admin)
+	}
+	filter := bson.M{
+		"$and": bson.A{
+			participantWithRole(user.ID, participant.Role),
+			participantWithRole(targetID, bson.M{"$nin": protected}),
+		},
+	}
+	update := bson.M{
+		"$pull": bson.M{"participants": bson.M{"id": targetID}},
+	}
+	if err := updateGroupRoom(room.ID, filter, update); err != nil {
+		return nil, err
+	}
+
+	recipients := room.ParticipantIDs()
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("[RemoveParticipant] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), recipients, NewEvent(RoomMemberRemoved, RoomEventPayload{
+		Room:    room,
+		ActorID: user.ID.Hex(),
+		UserIDs: []string{participantID},
+	}))
+
+	return room, nil
+}
+
+func UpdateParticipantRole(user *User, roomID, participantID string, input UpdateParticipantRoleInput) (*Room, error) {
+	if input.Role != Admin && input.Role != Member {
+		return nil, ErrInvalidRole
+	}
+
+	targetID, err := primitive.ObjectIDFromHex(participantID)
+	if err != nil {
+		return nil, err
+	}
+
+	room, participant, err := findGroupRoomForMember(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if participant.Role != Owner {
+		return nil, ErrRoomPermission
+	}
+
+	target := room.FindParticipant(targetID)
+	if target == nil {
+		return nil, ErrParticipantNotFound
+	}
+
+	if target.Role == Owner {
+		return nil, ErrRoomPermission
+	}
+
+	filter := bson.M{
+		"$and": bson.A{
+			participantWithRole(user.ID, Owner),
+			participantWithRole(targetID, bson.M{"$ne": Owner}),
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"participants.$[target].role": input.Role},
+	}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{
+			bson.M{"target.id": targetID},
+		},
+	})
+	if err := updateGroupRoom(room.ID, filter, update, opts); err != nil {
+		return nil, err
+	}
+
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("[UpdateParticipantRole] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), room.ParticipantIDs(), NewEvent(RoomUpdated, RoomEventPayload{
+		Room:    room,
+		ActorID: user.ID.Hex(),
+		UserIDs: []string{participantID},
+	}))
+
+	return room, nil
+}
+
+// transferOwnership swaps the owner role in a single update, the previous
+// owner stays in the room as an admin.
+func transferOwnership(room *Room, fromID, toID primitive.ObjectID) error {
+	filter := bson.M{
+		"participants": bson.M{"$elemMatch": bson.M{"id": fromID, "role": Owner}},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"participants.$[from].role": Admin,
+			"participants.$[to].role":   Owner,
+		},
+	}
+	opts := options.Update().SetArrayFilters(options.ArrayFilters{
+		Filters: []interface{}{
+			bson.M{"from.id": fromID},
+			bson.M{"to.id": toID},
+		},
+	})
+
+	return updateGroupRoom(room.ID, filter, update, opts)
+}
+
+func TransferOwnership(user *User, roomID string, input TransferOwnershipInput) (*Room, error) {
+	targetID, err := primitive.ObjectIDFromHex(input.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	room, participant, err := findGroupRoomForMember(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if participant.Role != Owner || targetID == user.ID {
+		return nil, ErrRoomPermission
+	}
+
+	if room.FindParticipant(targetID) == nil {
+		return nil, ErrParticipantNotFound
+	}
+
+	if err := transferOwnership(room, user.ID, targetID); err != nil {
+		return nil, err
+	}
+
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("[TransferOwnership] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), room.ParticipantIDs(), NewEvent(RoomUpdated, RoomEventPayload{
+		Room:    room,
+		ActorID: user.ID.Hex(),
+		UserIDs: []string{input.UserID},
+	}))
+
+	return room, nil
+}
+
+// nextGroupOwner picks who inherits the room when the owner leaves, admins
+// come first and otherwise the earliest remaining member.
+func nextGroupOwner(room *Room, ownerID primitive.ObjectID) *Participant {
+	var next *Participant
+	for i := range room.Participants {
+		participant := &room.Participants[i]
+		if participant.ID == ownerID {
+			continue
+		}
+
+		if participant.Role == Admin {
+			return participant
+		}
+
+		if next == nil {
+			next = participant
+		}
+	}
+
+	return next
+}
+
+func LeaveRoom(user *User, roomID string) error {
+	room, participant, err := findGroupRoomForMember(roomID, user.ID)
+	if err != nil {
+		return err
+	}
+
+	// the owner can only leave once the room has another owner, or when
+	// nobody else is left in it
+	filter := participantWithRole(user.ID, bson.M{"$ne": Owner})
+	if participant.Role == Owner {
+		if next := nextGroupOwner(room, user.ID); next != nil {
+			if err := transferOwnership(room, user.ID, next.ID); err != nil {
+				return err
+			}
+		} else {
+			filter = bson.M{
+				"participants.id": user.ID,
+				"participants":    bson.M{"$size": 1},
+			}
+		}
+	}
+
+	update := bson.M{
+		"$pull": bson.M{"participants": bson.M{"id": user.ID}},
+	}
+	if err := updateGroupRoom(room.ID, filter, update); err != nil {
+		return err
+	}
+
+	recipients := room.ParticipantIDs()
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return fmt.Errorf("[LeaveRoom] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), recipients, NewEvent(RoomMemberLeft, RoomEventPayload{
+		Room:    room,
+		ActorID: user.ID.Hex(),
+		UserIDs: []string{user.ID.Hex()},
+	}))
+
+	return nil
+}
+
+func roomErrorStatus(err error) int {
+	switch err {
+	case mongo.ErrNoDocuments, primitive.ErrInvalidHex, ErrParticipantNotFound:
+		return 404
+	case ErrNotRoomParticipant, ErrRoomPermission:
+		return 403
+	}
+
+	return 422
+}
+
+func (f *RoomFunc) UpdateRoomHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[UpdateRoomHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to update room",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := UpdateRoomInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[UpdateRoomHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to update room, please check your request data",
+		})
+		return
+	}
+
+	room, err := f.UpdateRoomFunc(user, ctx.Param("room_id"), input)
+	if err != nil {
+		log.Printf("[UpdateRoomHandler] %v", err)
+		ctx.JSON(roomErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to update room",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully update room",
+		"data":    room,
+	})
+}
+
+func (f *RoomFunc) AddParticipantsHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[AddParticipantsHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to add participants",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := AddParticipantsInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[AddParticipantsHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to add participants, please check your request data",
+		})
+		return
+	}
+
+	room, err := f.AddParticipantsFunc(user, ctx.Param("room_id"), input)
+	if err != nil {
+		log.Printf("[AddParticipantsHandler] %v", err)
+		ctx.JSON(roomErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to add participants",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully add participants",
+		"data":    room,
+	})
+}
+
+func (f *RoomFunc) RemoveParticipantHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[RemoveParticipantHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to remove participant",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	room, err := f.RemoveParticipantFunc(user, ctx.Param("room_id"), ctx.Param("user_id"))
+	if err != nil {
+		log.Printf("[RemoveParticipantHandler] %v", err)
+		ctx.JSON(roomErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to remove participant",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully remove participant",
+		"data":    room,
+	})
+}
+
+func (f *RoomFunc) UpdateParticipantRoleHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[UpdateParticipantRoleHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to update participant role",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := UpdateParticipantRoleInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[UpdateParticipantRoleHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to update participant role, please check your request data",
+		})
+		return
+	}
+
+	room, err := f.UpdateParticipantRoleFunc(user, ctx.Param("room_id"), ctx.Param("user_id"), input)
+	if err != nil {
+		log.Printf("[UpdateParticipantRoleHandler] %v", err)
+		ctx.JSON(roomErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to update participant role",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully update participant role",
+		"data":    room,
+	})
+}
+
+func (f *RoomFunc) TransferOwnershipHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[TransferOwnershipHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to transfer room ownership",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := TransferOwnershipInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[TransferOwnershipHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to transfer room ownership, please check your request data",
+		})
+		return
+	}
+
+	room, err := f.TransferOwnershipFunc(user, ctx.Param("room_id"), input)
+	if err != nil {
+		log.Printf("[TransferOwnershipHandler] %v", err)
+		ctx.JSON(roomErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to transfer room ownership",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully transfer room ownership",
+		"data":    room,
+	})
+}
+
+func (f *RoomFunc) LeaveRoomHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[LeaveRoomHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to leave room",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	if err := f.LeaveRoomFunc(user, ctx.Param("room_id")); err != nil {
+		log.Printf("[LeaveRoomHandler] %v", err)
+		ctx.JSON(roomErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to leave room",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully leave room",
+	})
+}
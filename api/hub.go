@@ -0,0 +1,417 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	// Client is a single websocket connection. Reads happen on the handler
+	// goroutine and every write goes through the send buffer, so the
+	// connection only ever has one reader and one writer.
+	Client struct {
+		hub       *Hub
+		conn      *websocket.Conn
+		send      chan outbound
+		done      chan struct{}
+		closeOnce sync.Once
+		closeCode int
+		closeText string
+		ID        string
+		UserID    string
+		Username  string
+		Email     string
+		RoomID    string
+
+		// the token the connection was opened with, revoking it closes the
+		// connection
+		TokenID   string
+		SessionID string
+		IssuedAt  time.Time
+
+		// guards the replay state, live events are held back while the
+		// session catches up on the ones it missed
+		mu          sync.Mutex
+		replaying   bool
+		pending     []pendingEvent
+		lastEventID string
+	}
+
+	// outbound is a frame waiting in the send buffer. A chat message carries
+	// its receipt, so the delivery is recorded once the frame was written.
+	outbound struct {
+		data    []byte
+		receipt *hubReceipt
+	}
+
+	// Hub keeps track of the connected clients. A user can hold many
+	// sessions at once, one per device, tab or opened room, and every session
+	// receives the events addressed to that user.
+	Hub struct {
+		mu      sync.RWMutex
+		clients map[string]map[*Client]struct{}
+	}
+)
+
+const (
+	// time allowed to write a message to the peer
+	writeWait = 10 * time.Second
+	// time allowed to read the next pong message from the peer
+	pongWait = 60 * time.Second
+	// send pings to peer with this period, must be less than pongWait
+	pingPeriod = (pongWait * 9) / 10
+	// maximum message size allowed from peer
+	maxMessageSize = 32 * 1024
+	// number of outgoing messages buffered before a client is dropped
+	sendBufferSize = 256
+	// number of live events held back during a replay before a client is
+	// dropped
+	maxPendingEvents = 4 * sendBufferSize
+)
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin: func(r *http.Request) bool {
+		// TODO: should check the origin request from client
+		return true
+	},
+}
+
+var wsHub = NewHub()
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[string]map[*Client]struct{}),
+	}
+}
+
+func NewClient(hub *Hub, conn *websocket.Conn, user *User, roomID string) *Client {
+	return &Client{
+		hub:       hub,
+		conn:      conn,
+		send:      make(chan outbound, sendBufferSize),
+		done:      make(chan struct{}),
+		closeCode: websocket.CloseNormalClosure,
+		ID:        primitive.NewObjectID().Hex(),
+		UserID:    user.ID.Hex(),
+		Username:  user.Username,
+		Email:     user.Email,
+		RoomID:    roomID,
+	}
+}
+
+func (c *Client) SetToken(claims *AuthClaims) {
+	c.TokenID = claims.RegisteredClaims.ID
+	c.SessionID = claims.SessionID
+	if claims.IssuedAt != nil {
+		c.IssuedAt = claims.IssuedAt.Time
+	}
+}
+
+func (h *Hub) Register(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sessions, ok := h.clients[c.UserID]
+	if !ok {
+		sessions = make(map[*Client]struct{})
+		h.clients[c.UserID] = sessions
+	}
+	sessions[c] = struct{}{}
+}
+
+func (h *Hub) Unregister(c *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sessions, ok := h.clients[c.UserID]
+	if !ok {
+		return
+	}
+
+	delete(sessions, c)
+	if len(sessions) == 0 {
+		delete(h.clients, c.UserID)
+	}
+}
+
+// Sessions returns the connected clients of the user on this instance.
+func (h *Hub) Sessions(userID string) []*Client {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	sessions := make([]*Client, 0, len(h.clients[userID]))
+	for c := range h.clients[userID] {
+		sessions = append(sessions, c)
+	}
+
+	return sessions
+}
+
+// HasRoomSession tells whether the user has a session opened in the room on
+// this instance, other than the given one.
+func (h *Hub) HasRoomSession(userID, roomID string, except *Client) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients[userID] {
+		if c != except && c.RoomID == roomID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// deliver queues the encoded data on every local session of the listed users,
+// users without a connection on this instance are skipped. The data of a user
+// with an event ID gets that ID set, so the session can resume from it.
+func (h *Hub) deliver(userIDs []string, data []byte, eventIDs map[string]string, receipt *hubReceipt) {
+	h.mu.RLock()
+	recipients := make(map[string][]*Client, len(userIDs))
+	for _, userID := range userIDs {
+		for c := range h.clients[userID] {
+			recipients[userID] = append(recipients[userID], c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for userID, sessions := range recipients {
+		eventID := eventIDs[userID]
+		userData := data
+		if eventID != "" {
+			var err error
+			userData, err = withEventID(data, eventID)
+			if err != nil {
+				log.Printf("[Hub.deliver] %v", err)
+				continue
+			}
+		}
+
+		for _, c := range sessions {
+			c.EnqueueEvent(eventID, outbound{data: userData, receipt: receipt})
+		}
+	}
+}
+
+// Enqueue hands the data to the write pump without blocking. A client whose
+// buffer is full is too slow to keep up and gets disconnected, so it can't
+// stall the sender.
+func (c *Client) Enqueue(data []byte) bool {
+	return c.enqueue(outbound{data: data})
+}
+
+func (c *Client) enqueue(out outbound) bool {
+	select {
+	case <-c.done:
+		return false
+	default:
+	}
+
+	select {
+	case c.send <- out:
+		return true
+	default:
+		log.Printf("[Client.Enqueue] dropping slow client of user %s", c.UserID)
+		c.CloseWithReason(websocket.CloseTryAgainLater, "client is too slow")
+		return false
+	}
+}
+
+// EnqueueEvent queues a live event, unless the session already got it through
+// a replay. Events arriving during a replay are held until it is over.
+func (c *Client) EnqueueEvent(id string, out outbound) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.replaying {
+		// a session that can't catch up is dropped like any slow client
+		if len(c.pending) >= maxPendingEvents {
+			log.Printf("[Client.EnqueueEvent] dropping slow client of user %s", c.UserID)
+			c.CloseWithReason(websocket.CloseTryAgainLater, "client is too slow")
+			return false
+		}
+		c.pending = append(c.pending, pendingEvent{ID: id, Out: out})
+		return true
+	}
+
+	if id == "" {
+		return c.enqueue(out)
+	}
+
+	if !eventIDAfter(id, c.lastEventID) {
+		return true
+	}
+
+	if !c.enqueue(out) {
+		return false
+	}
+	c.lastEventID = id
+
+	return true
+}
+
+// enqueueBlocking waits for room in the send buffer instead of dropping the
+// client, a replay sends far more than the buffer holds at once.
+func (c *Client) enqueueBlocking(out outbound) bool {
+	select {
+	case c.send <- out:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+func (c *Client) sendBlocking(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[Client.sendBlocking] %v", err)
+		return false
+	}
+
+	return c.enqueueBlocking(outbound{data: data})
+}
+
+func (c *Client) startReplay() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.replaying = true
+}
+
+func (c *Client) setLastEventID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastEventID = id
+}
+
+// finishReplay sends the live events held back during the replay, skipping
+// the ones the replay already covered, and lets the next ones through. The
+// lock is only held to take the held back events, so the hub can keep adding
+// to them while this session waits for room in its buffer.
+func (c *Client) finishReplay() {
+	for {
+		c.mu.Lock()
+		pending := c.pending
+		c.pending = nil
+		if len(pending) == 0 {
+			c.replaying = false
+			c.mu.Unlock()
+			return
+		}
+		lastEventID := c.lastEventID
+		c.mu.Unlock()
+
+		for _, event := range pending {
+			if event.ID != "" && !eventIDAfter(event.ID, lastEventID) {
+				continue
+			}
+
+			if !c.enqueueBlocking(event.Out) {
+				c.mu.Lock()
+				c.replaying = false
+				c.mu.Unlock()
+				return
+			}
+			if event.ID != "" {
+				lastEventID = event.ID
+			}
+		}
+
+		c.setLastEventID(lastEventID)
+	}
+}
+
+func (c *Client) SendJSON(v interface{}) bool {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[Client.SendJSON] %v", err)
+		return false
+	}
+
+	return c.Enqueue(data)
+}
+
+func (c *Client) Close() {
+	c.CloseWithReason(websocket.CloseNormalClosure, "")
+}
+
+// CloseWithReason unregisters the client and asks the write pump to send a
+// close frame, the connection itself is closed once the pump returns.
+func (c *Client) CloseWithReason(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		close(c.done)
+		c.hub.Unregister(c)
+	})
+}
+
+// WritePump writes queued messages and keepalive pings to the connection, it
+// is the only goroutine allowed to write to it.
+func (c *Client) WritePump() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.Close()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case out := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, out.data); err != nil {
+				log.Printf("[Client.WritePump] %v", err)
+				return
+			}
+			// the message only counts as delivered once it left the server
+			if out.receipt != nil && out.receipt.SenderID != c.UserID {
+				go MarkMessageDelivered(out.receipt.MessageID, c.UserID)
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			msg := websocket.FormatCloseMessage(c.closeCode, c.closeText)
+			c.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(writeWait))
+			return
+		}
+	}
+}
+
+// ReadPump reads messages from the connection until it is closed, the peer
+// has to answer pings in time or the read deadline closes the connection.
+func (c *Client) ReadPump(handle func([]byte)) {
+	defer c.Close()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		go PresenceHeartbeat(c)
+		return nil
+	})
+
+	for {
+		_, data, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+				log.Printf("[Client.ReadPump] %v", err)
+			}
+			return
+		}
+
+		handle(data)
+	}
+}
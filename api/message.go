@@ -4,75 +4,117 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
-	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type (
 	SendMessageInput struct {
 		Body       string  `json:"body"`
 		Attachment *string `json:"attachment"`
+		Nonce      string  `json:"nonce"`
+		ReplyTo    string  `json:"replyTo"`
+	}
+
+	EditMessageInput struct {
+		Body string `json:"body"`
+	}
+
+	MessageDeletedPayload struct {
+		ID        string    `json:"id"`
+		RoomID    string    `json:"roomId"`
+		DeletedAt time.Time `json:"deletedAt"`
+	}
+
+	MessageRevision struct {
+		Body      string    `bson:"body" json:"body"`
+		CreatedAt time.Time `bson:"createdAt" json:"createdAt"`
 	}
 
 	SendMessageOutput struct {
-		ID         string    `json:"id"`
-		Body       string    `json:"body"`
-		Attachment *string   `json:"attachment"`
-		UserID     string    `json:"userId"`
-		RoomID     string    `json:"roomId"`
-		User       *User     `json:"user"`
-		Room       *Room     `json:"room"`
-		CreatedAt  time.Time `json:"createdAt"`
-		UpdatedAt  time.Time `json:"updatedAt"`
+		ID         string          `json:"id"`
+		Body       string          `json:"body"`
+		Attachment *string         `json:"attachment"`
+		Nonce      string          `json:"nonce,omitempty"`
+		ReplyTo    *string         `json:"replyTo,omitempty"`
+		Parent     *MessagePreview `json:"parent,omitempty"`
+		Status     MessageStatus   `json:"status"`
+		UserID     string          `json:"userId"`
+		RoomID     string          `json:"roomId"`
+		User       *User           `json:"user"`
+		Room       *Room           `json:"room"`
+		CreatedAt  time.Time       `json:"createdAt"`
+		UpdatedAt  time.Time       `json:"updatedAt"`
 	}
 
 	GetMessagesInput struct {
+		User   *User
 		RoomID string
 		Cursor string
+		Before string
+		After  string
+		Around string
 		Limit  int64
 	}
 
 	GetMessageOutput struct {
-		Cursor   string
-		Limit    int64
-		Messages []Message
+		Cursor     string
+		PrevCursor string
+		NextCursor string
+		Limit      int64
+		Messages   []Message
 	}
 
-	WebSocketConnection struct {
-		*websocket.Conn
-		UserID   string
-		Username string
-		Email    string
-		RoomID   string
+	MessageCursor struct {
+		ID        string    `json:"id"`
+		CreatedAt time.Time `json:"createdAt"`
 	}
 
-	// key using user id
-	UserConnection map[string]WebSocketConnection
-
 	Message struct {
-		ID         primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-		Body       string             `bson:"body" json:"body"`
-		Attachment *string            `bson:"attachment" json:"attachment"`
-		UserID     primitive.ObjectID `bson:"userId,omitempty" json:"userId"`
-		RoomID     primitive.ObjectID `bson:"roomId,omitempty" json:"roomId"`
-		CreatedAt  time.Time          `bson:"createdAt,omitempty" json:"createdAt"`
-		UpdatedAt  time.Time          `bson:"updatedAt,omitempty" json:"updatedAt"`
-		DeletedAt  time.Time          `bson:"deletedAt,omitempty" json:"-"`
-		User       *User              `bson:"user,omitempty" json:"user"`
-		Room       *Room              `bson:"room,omitempty" json:"room"`
+		ID          primitive.ObjectID  `bson:"_id,omitempty" json:"id"`
+		Body        string              `bson:"body" json:"body"`
+		Attachment  *string             `bson:"attachment" json:"attachment"`
+		Nonce       string              `bson:"nonce,omitempty" json:"nonce,omitempty"`
+		UserID      primitive.ObjectID  `bson:"userId,omitempty" json:"userId"`
+		RoomID      primitive.ObjectID  `bson:"roomId,omitempty" json:"roomId"`
+		CreatedAt   time.Time           `bson:"createdAt,omitempty" json:"createdAt"`
+		UpdatedAt   time.Time           `bson:"updatedAt,omitempty" json:"updatedAt"`
+		EditedAt    *time.Time          `bson:"editedAt,omitempty" json:"editedAt,omitempty"`
+		DeletedAt   *time.Time          `bson:"deletedAt,omitempty" json:"-"`
+		Revisions   []MessageRevision   `bson:"revisions,omitempty" json:"-"`
+		Receipts    []MessageReceipt    `bson:"receipts,omitempty" json:"-"`
+		Reactions   []MessageReaction   `bson:"reactions,omitempty" json:"-"`
+		ReplyToID   *primitive.ObjectID `bson:"replyTo,omitempty" json:"replyTo,omitempty"`
+		ReplyCount  int64               `bson:"replyCount,omitempty" json:"replyCount"`
+		LastReplyAt *time.Time          `bson:"lastReplyAt,omitempty" json:"lastReplyAt,omitempty"`
+		Parent      *MessagePreview     `bson:"parent,omitempty" json:"parent,omitempty"`
+		Status      MessageStatus       `bson:"-" json:"status"`
+
+		ReactionSummaries []ReactionSummary `bson:"-" json:"reactions"`
+
+		User *User `bson:"user,omitempty" json:"user"`
+		Room *Room `bson:"room,omitempty" json:"room"`
 	}
 
 	MessageFunc struct {
-		GetMessagesFunc func(GetMessagesInput) GetMessageOutput
+		SendMessageFunc    func(*User, string, SendMessageInput) (*SendMessageOutput, error)
+		GetMessagesFunc    func(GetMessagesInput) (GetMessageOutput, error)
+		EditMessageFunc    func(*User, string, string, EditMessageInput) (*Message, error)
+		DeleteMessageFunc  func(*User, string, string) (*MessageDeletedPayload, error)
+		SearchMessagesFunc func(*User, SearchMessagesInput) (SearchMessagesOutput, error)
+		AddReactionFunc    func(*User, string, string, ReactionInput) (*ReactionPayload, error)
+		RemoveReactionFunc func(*User, string, string, ReactionInput) (*ReactionPayload, error)
+		GetThreadFunc      func(GetThreadInput) (GetThreadOutput, error)
 	}
 )
 
@@ -80,16 +122,16 @@ const (
 	messages string = "messages"
 )
 
-var wsUpgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		// TODO: should check the origin request from client
-		return true
-	},
-}
+var (
+	// largest page of messages a client can ask for
+	MaxMessagesLimit = 100
+)
 
-var userConnection = make(UserConnection)
+var (
+	ErrMessageNotFound    = errors.New("message not found")
+	ErrNotMessageAuthor   = errors.New("only the author can change the message")
+	ErrMessageBodyMissing = errors.New("message body is required")
+)
 
 func (m *Message) Save() error {
 	m.CreatedAt = time.Now()
@@ -100,47 +142,390 @@ func (m *Message) Save() error {
 	}
 	m.ID = res.InsertedID.(primitive.ObjectID)
 
-	if err := SaveLastMessageInRoom(m.RoomID.Hex(), m.Body); err != nil {
-		return err
+	return nil
+}
+
+func CreateMessageIndexes() error {
+	indexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{"roomId", 1}, {"createdAt", -1}, {"_id", -1}},
+		},
+		{
+			Keys: bson.D{{"userId", 1}, {"nonce", 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"nonce": bson.M{"$exists": true}}),
+		},
+		{
+			Keys:    bson.D{{"body", "text"}},
+			Options: options.Index().SetName("body_text"),
+		},
+	}
+
+	_, err := MongoDatabase.Collection(messages).Indexes().CreateMany(context.Background(), indexes)
+	if err != nil {
+		return fmt.Errorf("[CreateMessageIndexes] %v", err)
 	}
+
 	return nil
 }
 
-func FindMessageByRoomID(roomID string, cursorObj map[string]interface{}, limit int64) ([]Message, error) {
-	objID, err := primitive.ObjectIDFromHex(roomID)
+func FindMessageByNonce(userID primitive.ObjectID, nonce string) (*Message, error) {
+	filter := bson.M{
+		"userId": userID,
+		"nonce":  nonce,
+	}
+
+	var message Message
+	if err := MongoDatabase.Collection(messages).FindOne(context.Background(), filter).Decode(&message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+func FindMessageByID(id string) (*Message, error) {
+	objID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
-		return []Message{}, err
+		return nil, err
 	}
 
-	pipeline := mongo.Pipeline{
-		bson.D{{"$match", bson.D{{"roomId", bson.D{{"$eq", objID}}}}}},
-		bson.D{{"$sort", bson.D{{"createdAt", -1}, {"_id", -1}}}},
+	filter := bson.M{
+		"_id": objID,
 	}
 
-	if len(cursorObj) != 0 {
-		id := cursorObj["id"].(string)
-		createdAt, err := time.Parse(time.RFC3339, cursorObj["createdAt"].(string))
+	var message Message
+	if err := MongoDatabase.Collection(messages).FindOne(context.Background(), filter).Decode(&message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// FindLatestMessageInRoom returns the newest message of the room that hasn't
+// been deleted.
+func FindLatestMessageInRoom(roomID primitive.ObjectID) (*Message, error) {
+	filter := bson.M{
+		"roomId":    roomID,
+		"deletedAt": bson.M{"$exists": false},
+	}
+	opts := options.FindOne().SetSort(bson.D{{"createdAt", -1}, {"_id", -1}})
+
+	var message Message
+	if err := MongoDatabase.Collection(messages).FindOne(context.Background(), filter, opts).Decode(&message); err != nil {
+		return nil, err
+	}
+
+	return &message, nil
+}
+
+// SendMessage stores a message written by the user and delivers it to the
+// room. A retried send with the same nonce returns the message stored by the
+// first attempt instead of creating a duplicate.
+func SendMessage(user *User, roomID string, input SendMessageInput) (*SendMessageOutput, error) {
+	if strings.TrimSpace(input.Body) == "" && input.Attachment == nil {
+		return nil, ErrMessageBodyMissing
+	}
+
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.Nonce != "" {
+		message, err := FindMessageByNonce(user.ID, input.Nonce)
+		if err == nil {
+			return NewSendMessageOutput(message, user, room), nil
+		}
+		if err != mongo.ErrNoDocuments {
+			return nil, fmt.Errorf("[SendMessage] %v", err)
+		}
+	}
+
+	var parent *Message
+	if input.ReplyTo != "" {
+		parent, err = findReplyParent(room, input.ReplyTo)
 		if err != nil {
-			return []Message{}, err
+			return nil, err
+		}
+	}
+
+	message := &Message{
+		Body:       input.Body,
+		Attachment: input.Attachment,
+		Nonce:      input.Nonce,
+		RoomID:     room.ID,
+		UserID:     user.ID,
+		Receipts:   NewMessageReceipts(room, user.ID),
+	}
+	if parent != nil {
+		message.ReplyToID = &parent.ID
+	}
+	if err := message.Save(); err != nil {
+		// a concurrent retry stored the message first
+		if input.Nonce != "" && mongo.IsDuplicateKeyError(err) {
+			message, err = FindMessageByNonce(user.ID, input.Nonce)
+			if err != nil {
+				return nil, fmt.Errorf("[SendMessage] %v", err)
+			}
+			return NewSendMessageOutput(message, user, room), nil
+		}
+		return nil, fmt.Errorf("[SendMessage] %v", err)
+	}
+
+	if err := SaveLastMessageInRoom(message, user); err != nil {
+		log.Printf("[SendMessage] %v", err)
+	}
+
+	if parent != nil {
+		message.Parent = NewMessagePreview(parent)
+		if err := addReplyToThread(room, parent, message); err != nil {
+			log.Printf("[SendMessage] %v", err)
+		}
+	}
+
+	output := NewSendMessageOutput(message, user, room)
+
+	// whoever writes in the room has seen everything before the message
+	if _, err := MarkRoomAsRead(user, roomID, MarkRoomReadInput{MessageID: output.ID}); err != nil {
+		log.Printf("[SendMessage] %v", err)
+	}
+
+	// every participant receives the message, including the sender so all of
+	// the sender's sessions render what was stored on the server
+	wsHub.PublishMessage(roomID, room.ParticipantIDs(), NewEvent(MessageCreated, output), output.ID, output.UserID)
+
+	return output, nil
+}
+
+func NewSendMessageOutput(message *Message, user *User, room *Room) *SendMessageOutput {
+	var replyTo *string
+	if message.ReplyToID != nil {
+		id := message.ReplyToID.Hex()
+		replyTo = &id
+	}
+
+	return &SendMessageOutput{
+		ID:         message.ID.Hex(),
+		Body:       message.Body,
+		Attachment: message.Attachment,
+		Nonce:      message.Nonce,
+		ReplyTo:    replyTo,
+		Parent:     message.Parent,
+		Status:     message.DeliveryStatus(),
+		UserID:     message.UserID.Hex(),
+		RoomID:     message.RoomID.Hex(),
+		User:       user,
+		Room:       room,
+		CreatedAt:  message.CreatedAt,
+		UpdatedAt:  message.UpdatedAt,
+	}
+}
+
+// authorMessageFilter matches a message only while it is still visible and was
+// written by the user, so edits and deletes can't race a concurrent delete.
+func authorMessageFilter(roomID, messageID string, userID primitive.ObjectID) (bson.M, error) {
+	roomObjID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	msgObjID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	return bson.M{
+		"_id":       msgObjID,
+		"roomId":    roomObjID,
+		"userId":    userID,
+		"deletedAt": bson.M{"$exists": false},
+	}, nil
+}
+
+// messageChangeError explains why an author filter didn't match anything.
+func messageChangeError(roomID, messageID string, userID primitive.ObjectID) error {
+	message, err := FindMessageByID(messageID)
+	if err != nil {
+		return ErrMessageNotFound
+	}
+
+	if message.RoomID.Hex() != roomID || message.DeletedAt != nil {
+		return ErrMessageNotFound
+	}
+
+	if message.UserID != userID {
+		return ErrNotMessageAuthor
+	}
+
+	return ErrMessageNotFound
+}
+
+func EditMessage(user *User, roomID, messageID string, input EditMessageInput) (*Message, error) {
+	body := strings.TrimSpace(input.Body)
+	if body == "" {
+		return nil, ErrMessageBodyMissing
+	}
+
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := authorMessageFilter(roomID, messageID, user.ID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	// the previous body is moved into the revisions by the same update that
+	// replaces it, so concurrent edits can't lose a revision
+	now := time.Now()
+	update := mongo.Pipeline{
+		bson.D{{"$set", bson.D{
+			{"revisions", bson.D{{"$concatArrays", bson.A{
+				bson.D{{"$ifNull", bson.A{"$revisions", bson.A{}}}},
+				bson.A{bson.D{{"body", "$body"}, {"createdAt", "$updatedAt"}}},
+			}}}},
+			{"body", body},
+			{"editedAt", now},
+			{"updatedAt", now},
+		}}},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	err = MongoDatabase.Collection(messages).FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return nil, messageChangeError(roomID, messageID, user.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[EditMessage] %v", err)
+	}
+
+	if err := RefreshLastMessageInRoom(room.ID, message.ID); err != nil {
+		log.Printf("[EditMessage] %v", err)
+	}
+
+	message.User = user
+	message.Status = message.DeliveryStatus()
+	message.ReactionSummaries = SummarizeReactions(message.Reactions, nil)
+	SendEvent(roomID, room.ParticipantIDs(), NewEvent(MessageUpdated, message))
+
+	return &message, nil
+}
+
+// DeleteMessage keeps the message as a tombstone, the content is removed
+// but the document stays so clients can still refer to it.
+func DeleteMessage(user *User, roomID, messageID string) (*MessageDeletedPayload, error) {
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := authorMessageFilter(roomID, messageID, user.ID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	now := time.Now()
+	update := bson.M{
+		"$set": bson.M{
+			"body":       "",
+			"attachment": nil,
+			"deletedAt":  now,
+			"updatedAt":  now,
+		},
+		"$unset": bson.M{
+			"revisions": "",
+			"reactions": "",
+		},
+	}
+
+	var message Message
+	err = MongoDatabase.Collection(messages).FindOneAndUpdate(context.Background(), filter, update).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return nil, messageChangeError(roomID, messageID, user.ID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[DeleteMessage] %v", err)
+	}
+
+	if err := RefreshLastMessageInRoom(room.ID, message.ID); err != nil {
+		log.Printf("[DeleteMessage] %v", err)
+	}
+
+	if message.ReplyToID != nil {
+		if err := removeReplyFromThread(room, *message.ReplyToID); err != nil {
+			log.Printf("[DeleteMessage] %v", err)
+		}
+	}
+
+	// a deleted message has nothing left to pin
+	if room.FindPin(message.ID) != nil {
+		if err := unpinMessage(room, message.ID, user.ID); err != nil {
+			log.Printf("[DeleteMessage] %v", err)
 		}
+	}
+
+	deleted := &MessageDeletedPayload{
+		ID:        messageID,
+		RoomID:    roomID,
+		DeletedAt: now,
+	}
+	SendEvent(roomID, room.ParticipantIDs(), NewEvent(MessageDeleted, deleted))
+
+	return deleted, nil
+}
 
-		msgObjID, err := primitive.ObjectIDFromHex(id)
-		timeObj := primitive.NewDateTimeFromTime(createdAt)
+// FindMessageByRoomID returns a page of messages next to the anchor, the
+// older ones newest first or the newer ones oldest first. Without an anchor it
+// starts from the newest message of the room. An inclusive page also holds the
+// anchor itself.
+func FindMessageByRoomID(roomID string, anchor *MessageCursor, older, inclusive bool, limit int64) ([]Message, error) {
+	objID, err := primitive.ObjectIDFromHex(roomID)
+	if err != nil {
+		return []Message{}, err
+	}
+
+	match := bson.D{
+		{"roomId", bson.D{{"$eq", objID}}},
+		{"deletedAt", bson.D{{"$exists", false}}},
+	}
+
+	return findMessages(match, anchor, older, inclusive, limit)
+}
+
+// findMessages runs the query shared by the message listings, the messages
+// come with their author, room and replied message.
+func findMessages(match bson.D, anchor *MessageCursor, older, inclusive bool, limit int64) ([]Message, error) {
+	timeOp, idOp, order := "$gt", "$gt", 1
+	if older {
+		timeOp, idOp, order = "$lt", "$lt", -1
+	}
+	if inclusive {
+		idOp += "e"
+	}
+
+	if anchor != nil {
+		msgObjID, err := primitive.ObjectIDFromHex(anchor.ID)
 		if err != nil {
 			return []Message{}, err
 		}
-
-		pipeline = append(pipeline, bson.D{
-			{"$match",
-				bson.D{
-					{"createdAt", bson.D{{"$gt", timeObj}}},
-					{"_id", bson.D{{"$gt", msgObjID}}},
-				},
+		timeObj := primitive.NewDateTimeFromTime(anchor.CreatedAt)
+
+		// messages sharing the creation time of the anchor are ordered by id
+		match = append(match, bson.E{"$or", bson.A{
+			bson.D{{"createdAt", bson.D{{timeOp, timeObj}}}},
+			bson.D{
+				{"createdAt", timeObj},
+				{"_id", bson.D{{idOp, msgObjID}}},
 			},
-		})
+		}})
 	}
 
-	pipeline = append(pipeline,
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", match}},
+		bson.D{{"$sort", bson.D{{"createdAt", order}, {"_id", order}}}},
 		bson.D{
 			{"$lookup",
 				bson.D{
@@ -163,7 +548,19 @@ func FindMessageByRoomID(roomID string, cursorObj map[string]interface{}, limit
 			},
 		},
 		bson.D{{"$unwind", bson.D{{"path", "$room"}}}},
-		bson.D{{"$limit", limit}})
+		bson.D{
+			{"$lookup",
+				bson.D{
+					{"from", "messages"},
+					{"localField", "replyTo"},
+					{"foreignField", "_id"},
+					{"as", "parent"},
+				},
+			},
+		},
+		bson.D{{"$unwind", bson.D{{"path", "$parent"}, {"preserveNullAndEmptyArrays", true}}}},
+		bson.D{{"$limit", limit}},
+	}
 
 	cursor, err := MongoDatabase.Collection(messages).Aggregate(context.Background(), pipeline)
 	if err != nil {
@@ -176,6 +573,9 @@ func FindMessageByRoomID(roomID string, cursorObj map[string]interface{}, limit
 		if err := cursor.Decode(&message); err != nil {
 			return []Message{}, err
 		}
+		if message.Parent != nil {
+			message.Parent.Trim()
+		}
 		messages = append(messages, message)
 	}
 	if err := cursor.Err(); err != nil {
@@ -185,177 +585,221 @@ func FindMessageByRoomID(roomID string, cursorObj map[string]interface{}, limit
 	return messages, nil
 }
 
-func GetMessages(input GetMessagesInput) GetMessageOutput {
-	cursorInput := make(map[string]interface{})
-	if input.Cursor != "" {
-		d, err := base64.StdEncoding.DecodeString(input.Cursor)
-		if err != nil {
-			log.Printf("[GetMessages] %v", err)
-			return GetMessageOutput{
-				Limit:    input.Limit,
-				Messages: []Message{},
-			}
-		}
-		err = json.Unmarshal(d, &cursorInput)
-		if err != nil {
-			log.Printf("[GetMessages] %v", err)
-			return GetMessageOutput{
-				Limit:    input.Limit,
-				Messages: []Message{},
-			}
+// findMessagePage reads one message more than the limit to tell whether the
+// page is the last one in its direction. The page is always newest first.
+func findMessagePage(roomID string, anchor *MessageCursor, older, inclusive bool, limit int64) ([]Message, bool, error) {
+	messages, err := FindMessageByRoomID(roomID, anchor, older, inclusive, limit+1)
+	if err != nil {
+		return []Message{}, false, err
+	}
+
+	hasMore := int64(len(messages)) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+
+	if !older {
+		for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+			messages[i], messages[j] = messages[j], messages[i]
 		}
 	}
 
-	messages, err := FindMessageByRoomID(input.RoomID, cursorInput, input.Limit)
+	return messages, hasMore, nil
+}
+
+func NewMessageCursor(message Message) MessageCursor {
+	return MessageCursor{
+		ID:        message.ID.Hex(),
+		CreatedAt: message.CreatedAt,
+	}
+}
+
+func (c MessageCursor) Encode() (string, error) {
+	jsonCursor, err := json.Marshal(c)
 	if err != nil {
-		log.Printf("[GetMessages] %v", err)
-		return GetMessageOutput{
-			Limit:    input.Limit,
-			Messages: []Message{},
-		}
+		return "", err
 	}
 
-	var cursor string
-	if len(messages) != 0 {
-		lastMessage := messages[len(messages)-1]
-		c := map[string]interface{}{
-			"id":        lastMessage.ID.Hex(),
-			"createdAt": lastMessage.CreatedAt,
-		}
-		jsonCursor, err := json.Marshal(c)
+	return base64.StdEncoding.EncodeToString(jsonCursor), nil
+}
+
+// decodeMessageAnchor reads an anchor given either as a cursor returned by a
+// previous page or as the id of a message in the room.
+func decodeMessageAnchor(roomID, value string) (*MessageCursor, error) {
+	if primitive.IsValidObjectID(value) {
+		message, err := FindMessageByID(value)
 		if err != nil {
-			log.Printf("[GetMessages] %v", err)
-			return GetMessageOutput{
-				Limit:    input.Limit,
-				Messages: []Message{},
-			}
+			return nil, err
+		}
+		if message.RoomID.Hex() != roomID {
+			return nil, ErrMessageNotFound
 		}
 
-		cursor = base64.StdEncoding.EncodeToString(jsonCursor)
+		cursor := NewMessageCursor(*message)
+		return &cursor, nil
 	}
 
-	output := GetMessageOutput{
-		Cursor:   cursor,
-		Limit:    input.Limit,
-		Messages: messages,
+	return DecodeMessageCursor(value)
+}
+
+func DecodeMessageCursor(value string) (*MessageCursor, error) {
+	decoded, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor MessageCursor
+	if err := json.Unmarshal(decoded, &cursor); err != nil {
+		return nil, err
 	}
 
-	return output
+	return &cursor, nil
 }
 
-func MessageDefaultHandler() *MessageFunc {
-	return &MessageFunc{
-		GetMessagesFunc: GetMessages,
+// GetMessages returns a page of the room timeline, newest message first. The
+// page holds the messages before or after an anchor, or the ones around a
+// given message, and the latest messages when there is no anchor at all. The
+// previous cursor leads to older messages and the next cursor to newer ones,
+// each is empty when there is nothing more that way.
+func GetMessages(input GetMessagesInput) (GetMessageOutput, error) {
+	emptyOutput := GetMessageOutput{
+		Limit:    input.Limit,
+		Messages: []Message{},
 	}
-}
 
-func (f *MessageFunc) WSHandler(ctx *gin.Context) {
-	conn, err := wsUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
-	if err != nil {
-		log.Printf("wsHandler: %v", err)
-		return
+	if input.User == nil {
+		return emptyOutput, ErrNotRoomParticipant
 	}
 
-	userCtx, ok := ctx.Get("user")
-	if !ok {
-		return
+	if _, err := FindRoomForParticipant(input.RoomID, input.User.ID); err != nil {
+		return emptyOutput, err
 	}
-	user := userCtx.(*User)
 
-	userID := user.ID.Hex()
-	roomID := ctx.Param("room_id")
-	wsConn := WebSocketConnection{
-		Conn:     conn,
-		UserID:   userID,
-		Username: user.Username,
-		Email:    user.Email,
-		RoomID:   roomID,
-	}
-	userConnection[userID] = wsConn
-
-	for {
-		var input SendMessageInput
-		err := conn.ReadJSON(&input)
-		if err != nil {
-			if strings.Contains(err.Error(), "websocket: close") {
-				delete(userConnection, userID)
-				return
-			}
+	before := input.Before
+	if before == "" {
+		before = input.Cursor
+	}
 
-			log.Printf("[WSHandler] %v", err)
-			continue
+	var (
+		messages           []Message
+		hasOlder, hasNewer bool
+	)
+	switch {
+	case input.Around != "":
+		anchor, err := decodeMessageAnchor(input.RoomID, input.Around)
+		if err != nil {
+			log.Printf("[GetMessages] %v", err)
+			return emptyOutput, nil
 		}
 
-		room, err := FindRoomByID(roomID)
+		newerLimit := input.Limit / 2
+		newer, more, err := findMessagePage(input.RoomID, anchor, false, false, newerLimit)
 		if err != nil {
-			log.Printf("[WSHandler] %v", err)
-			if err == mongo.ErrNoDocuments {
-				return
-			}
-			continue
+			log.Printf("[GetMessages] %v", err)
+			return emptyOutput, nil
 		}
+		hasNewer = more
 
-		var recipientID string
-		for _, participant := range room.Participants {
-			if participant.ID.Hex() != userID {
-				recipientID = participant.ID.Hex()
-			}
+		older, more, err := findMessagePage(input.RoomID, anchor, true, true, input.Limit-newerLimit)
+		if err != nil {
+			log.Printf("[GetMessages] %v", err)
+			return emptyOutput, nil
 		}
+		hasOlder = more
 
-		roomObjID, err := primitive.ObjectIDFromHex(roomID)
+		messages = append(newer, older...)
+	case input.After != "":
+		anchor, err := decodeMessageAnchor(input.RoomID, input.After)
 		if err != nil {
-			log.Printf("[WSHandler] %v", err)
-			continue
+			log.Printf("[GetMessages] %v", err)
+			return emptyOutput, nil
 		}
 
-		userObjID, err := primitive.ObjectIDFromHex(userID)
+		messages, hasNewer, err = findMessagePage(input.RoomID, anchor, false, false, input.Limit)
 		if err != nil {
-			log.Printf("[WSHandler] %v", err)
-			continue
-		}
-		message := Message{
-			Body:       input.Body,
-			Attachment: input.Attachment,
-			RoomID:     roomObjID,
-			UserID:     userObjID,
+			log.Printf("[GetMessages] %v", err)
+			return emptyOutput, nil
 		}
-		if err := message.Save(); err != nil {
-			log.Printf("[WSHandler] %v", err)
+		hasOlder = true
+	default:
+		var anchor *MessageCursor
+		if before != "" {
+			var err error
+			anchor, err = decodeMessageAnchor(input.RoomID, before)
+			if err != nil {
+				log.Printf("[GetMessages] %v", err)
+				return emptyOutput, nil
+			}
+			hasNewer = true
 		}
 
-		recipientConn, recipientPresent := userConnection[recipientID]
-		if recipientPresent {
-			recipientConn.WriteJSON(SendMessageOutput{
-				ID:         message.ID.Hex(),
-				Body:       input.Body,
-				Attachment: input.Attachment,
-				UserID:     user.ID.Hex(),
-				RoomID:     room.ID.Hex(),
-				User:       user,
-				Room:       room,
-				CreatedAt:  message.CreatedAt,
-				UpdatedAt:  message.UpdatedAt,
-			})
+		var err error
+		messages, hasOlder, err = findMessagePage(input.RoomID, anchor, true, false, input.Limit)
+		if err != nil {
+			log.Printf("[GetMessages] %v", err)
+			return emptyOutput, nil
 		}
+	}
 
-		senderConn, senderPresent := userConnection[userID]
-		if senderPresent {
-			senderConn.WriteJSON(SendMessageOutput{
-				ID:         message.ID.Hex(),
-				Body:       input.Body,
-				Attachment: input.Attachment,
-				UserID:     user.ID.Hex(),
-				RoomID:     room.ID.Hex(),
-				User:       user,
-				Room:       room,
-				CreatedAt:  message.CreatedAt,
-				UpdatedAt:  message.UpdatedAt,
-			})
+	for i := range messages {
+		messages[i].Status = messages[i].DeliveryStatus()
+		messages[i].ReactionSummaries = SummarizeReactions(messages[i].Reactions, &input.User.ID)
+	}
+
+	output := GetMessageOutput{
+		Limit:    input.Limit,
+		Messages: messages,
+	}
+
+	if len(messages) != 0 {
+		var err error
+		if hasOlder {
+			output.PrevCursor, err = NewMessageCursor(messages[len(messages)-1]).Encode()
+			if err != nil {
+				log.Printf("[GetMessages] %v", err)
+				return emptyOutput, nil
+			}
+		}
+		if hasNewer {
+			output.NextCursor, err = NewMessageCursor(messages[0]).Encode()
+			if err != nil {
+				log.Printf("[GetMessages] %v", err)
+				return emptyOutput, nil
+			}
 		}
 	}
+
+	// older clients page through the history with the cursor alone
+	output.Cursor = output.PrevCursor
+
+	return output, nil
+}
+
+func MessageDefaultHandler() *MessageFunc {
+	return &MessageFunc{
+		SendMessageFunc:    SendMessage,
+		GetMessagesFunc:    GetMessages,
+		EditMessageFunc:    EditMessage,
+		DeleteMessageFunc:  DeleteMessage,
+		SearchMessagesFunc: SearchMessages,
+		AddReactionFunc:    AddReaction,
+		RemoveReactionFunc: RemoveReaction,
+		GetThreadFunc:      GetThread,
+	}
 }
 
 func (f *MessageFunc) GetMessagesHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[GetMessagesHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to get messages",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
 	roomID := ctx.Param("room_id")
 	cursor := ctx.Query("cursor")
 	limitQuery := ctx.Query("limit")
@@ -364,29 +808,161 @@ func (f *MessageFunc) GetMessagesHandler(ctx *gin.Context) {
 	if limitQuery != "" {
 		var err error
 		limit, err = strconv.Atoi(limitQuery)
-		if err != nil {
-			log.Printf("[GetMessagesHandler] %v", err)
-			ctx.JSON(422, gin.H{
+		if err != nil || limit <= 0 || limit > MaxMessagesLimit {
+			log.Printf("[GetMessagesHandler] invalid limit %q", limitQuery)
+			ctx.JSON(400, gin.H{
 				"status":  "error",
-				"message": "Failed to get messages",
+				"message": fmt.Sprintf("Failed to get messages, limit should be between 1 and %d", MaxMessagesLimit),
 			})
 			return
 		}
 	}
 
 	input := GetMessagesInput{
+		User:   user,
 		RoomID: roomID,
 		Cursor: cursor,
+		Before: ctx.Query("before"),
+		After:  ctx.Query("after"),
+		Around: ctx.Query("around"),
 		Limit:  int64(limit),
 	}
-	output := f.GetMessagesFunc(input)
+	output, err := f.GetMessagesFunc(input)
+	if err != nil {
+		log.Printf("[GetMessagesHandler] %v", err)
+		ctx.JSON(messageErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to get messages",
+		})
+		return
+	}
 
 	ctx.JSON(200, gin.H{
 		"status": "success",
 		"meta": gin.H{
-			"limit":  input.Limit,
-			"cursor": output.Cursor,
+			"limit":      input.Limit,
+			"cursor":     output.Cursor,
+			"prevCursor": output.PrevCursor,
+			"nextCursor": output.NextCursor,
 		},
 		"data": output.Messages,
 	})
 }
+
+func messageErrorStatus(err error) int {
+	switch err {
+	case ErrMessageNotFound, mongo.ErrNoDocuments, primitive.ErrInvalidHex:
+		return 404
+	case ErrNotMessageAuthor, ErrNotRoomParticipant:
+		return 403
+	}
+
+	return 422
+}
+
+func (f *MessageFunc) SendMessageHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[SendMessageHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to send message",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := SendMessageInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[SendMessageHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to send message, please check your request data",
+		})
+		return
+	}
+
+	message, err := f.SendMessageFunc(user, ctx.Param("room_id"), input)
+	if err != nil {
+		log.Printf("[SendMessageHandler] %v", err)
+		ctx.JSON(messageErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to send message",
+		})
+		return
+	}
+
+	ctx.JSON(201, gin.H{
+		"status":  "success",
+		"message": "Successfully send message",
+		"data":    message,
+	})
+}
+
+func (f *MessageFunc) EditMessageHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[EditMessageHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to edit message",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := EditMessageInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[EditMessageHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to edit message, please check your request data",
+		})
+		return
+	}
+
+	message, err := f.EditMessageFunc(user, ctx.Param("room_id"), ctx.Param("message_id"), input)
+	if err != nil {
+		log.Printf("[EditMessageHandler] %v", err)
+		ctx.JSON(messageErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to edit message",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully edit message",
+		"data":    message,
+	})
+}
+
+func (f *MessageFunc) DeleteMessageHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[DeleteMessageHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to delete message",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	deleted, err := f.DeleteMessageFunc(user, ctx.Param("room_id"), ctx.Param("message_id"))
+	if err != nil {
+		log.Printf("[DeleteMessageHandler] %v", err)
+		ctx.JSON(messageErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to delete message",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully delete message",
+		"data":    deleted,
+	})
+}
@@ -0,0 +1,489 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+type (
+	// MFAChallenge is returned by the login of a user with two factor
+	// authentication, the token only works to finish the login with a code.
+	MFAChallenge struct {
+		MFARequired bool      `json:"mfaRequired"`
+		MFAToken    string    `json:"mfaToken"`
+		ExpiresAt   time.Time `json:"expiresAt"`
+	}
+
+	// VerifyMFAInput finishes the login with either a code of the
+	// authenticator app or one of the recovery codes.
+	VerifyMFAInput struct {
+		MFAToken     string        `json:"mfaToken"`
+		Code         string        `json:"code"`
+		RecoveryCode string        `json:"recoveryCode"`
+		Client       SessionClient `json:"-"`
+	}
+
+	EnrollTOTPOutput struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	ConfirmTOTPInput struct {
+		Code string `json:"code"`
+	}
+
+	ConfirmTOTPOutput struct {
+		RecoveryCodes []string `json:"recoveryCodes"`
+	}
+)
+
+var (
+	ErrMFARequired       = errors.New("second factor is required to finish the login")
+	ErrMFAAlreadyEnabled = errors.New("two factor authentication is already enabled")
+	ErrMFANotEnrolled    = errors.New("two factor authentication enrollment wasn't started")
+	ErrInvalidMFAToken   = errors.New("login token is invalid or expired, please login again")
+	ErrInvalidMFACode    = errors.New("authentication code is invalid")
+)
+
+var (
+	MFATokenExpDuration = time.Duration(5) * time.Minute
+	// wrong codes allowed with a single login token
+	MFAMaxAttempts int64 = 5
+	// codes a user can try within MFALockoutWindow, whatever login token they
+	// come with
+	MFAUserMaxAttempts int64 = 10
+	MFALockoutWindow         = time.Duration(15) * time.Minute
+	// recovery codes given when two factor authentication is enabled
+	RecoveryCodeCount = 10
+)
+
+var recoveryCodeLetters = []rune("abcdefghjkmnpqrstuvwxyz23456789")
+
+func mfaAttemptsKey(tokenID string) string {
+	return fmt.Sprintf("mfa_attempts:%s", tokenID)
+}
+
+func mfaUserAttemptsKey(userID string) string {
+	return fmt.Sprintf("mfa_attempts:user:%s", userID)
+}
+
+// newRecoveryCodes returns the codes to show to the user once and the hashes
+// to store.
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, RecoveryCodeCount)
+	hashes := make([]string, 0, RecoveryCodeCount)
+	max := big.NewInt(int64(len(recoveryCodeLetters)))
+
+	for i := 0; i < RecoveryCodeCount; i++ {
+		r := make([]rune, 10)
+		for j := range r {
+			n, err := rand.Int(rand.Reader, max)
+			if err != nil {
+				return nil, nil, err
+			}
+			r[j] = recoveryCodeLetters[n.Int64()]
+		}
+
+		code := string(r[:5]) + "-" + string(r[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+
+	return codes, hashes, nil
+}
+
+// recovery codes are compared without case, spaces or dashes, so they can be
+// typed the way they were written down
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+	return hashToken(code)
+}
+
+func signMFAToken(user *User) (*MFAChallenge, error) {
+	expiresAt := time.Now().Add(MFATokenExpDuration)
+	claims := AuthClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    AppName,
+			Subject:   user.ID.Hex(),
+			ID:        GenSecureToken(16),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		ID:         user.ID.Hex(),
+		MFAPending: true,
+	}
+
+	token := jwt.NewWithClaims(JwtSigningMethod, claims)
+	signedToken, err := token.SignedString(JwtSecretKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MFAChallenge{
+		MFARequired: true,
+		MFAToken:    signedToken,
+		ExpiresAt:   expiresAt,
+	}, nil
+}
+
+// parseMFAToken accepts a login token that wasn't used yet and still has
+// attempts left, every call counts as an attempt.
+func parseMFAToken(mfaToken string) (*AuthClaims, error) {
+	claims := &AuthClaims{}
+	token, err := jwt.ParseWithClaims(mfaToken, claims, authKeyFunc)
+	if err != nil || !token.Valid || !claims.MFAPending || claims.RegisteredClaims.ID == "" {
+		return nil, ErrInvalidMFAToken
+	}
+
+	revoked, err := IsTokenRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrInvalidMFAToken
+	}
+
+	attemptsKey := mfaAttemptsKey(claims.RegisteredClaims.ID)
+	pipe := RedisClient.TxPipeline()
+	attempts := pipe.Incr(context.Background(), attemptsKey)
+	pipe.Expire(context.Background(), attemptsKey, MFATokenExpDuration)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, fmt.Errorf("[parseMFAToken] %v", err)
+	}
+	if attempts.Val() > MFAMaxAttempts {
+		return nil, ErrInvalidMFAToken
+	}
+
+	return claims, nil
+}
+
+// countMFAAttempt counts a code tried by the user, so logging in again for a
+// fresh login token doesn't give more guesses. The count is cleared once a
+// code is accepted.
+func countMFAAttempt(userID string) error {
+	attemptsKey := mfaUserAttemptsKey(userID)
+	pipe := RedisClient.TxPipeline()
+	attempts := pipe.Incr(context.Background(), attemptsKey)
+	pipe.ExpireNX(context.Background(), attemptsKey, MFALockoutWindow)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return fmt.Errorf("[countMFAAttempt] %v", err)
+	}
+	if attempts.Val() > MFAUserMaxAttempts {
+		return ErrTooManyRequests
+	}
+
+	return nil
+}
+
+// useTOTPCode accepts a code of the authenticator app. The step of the code
+// is recorded by the same update that checks it, so a code can't be used
+// twice even by concurrent requests.
+func useTOTPCode(user *User, code string) error {
+	counter, ok := VerifyTOTP(user.TOTPSecret, code, time.Now())
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	filter := bson.M{
+		"_id": user.ID,
+		"$or": bson.A{
+			bson.M{"totpLastCounter": bson.M{"$exists": false}},
+			bson.M{"totpLastCounter": bson.M{"$lt": counter}},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"totpLastCounter": counter},
+	}
+
+	res, err := MongoDatabase.Collection(users).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return fmt.Errorf("[useTOTPCode] %v", err)
+	}
+	if res.ModifiedCount == 0 {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// useRecoveryCode removes the recovery code as it is accepted.
+func useRecoveryCode(user *User, code string) error {
+	hash := hashRecoveryCode(code)
+	filter := bson.M{
+		"_id":           user.ID,
+		"recoveryCodes": hash,
+	}
+	update := bson.M{
+		"$pull": bson.M{"recoveryCodes": hash},
+	}
+
+	res, err := MongoDatabase.Collection(users).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return fmt.Errorf("[useRecoveryCode] %v", err)
+	}
+	if res.ModifiedCount == 0 {
+		return ErrInvalidMFACode
+	}
+
+	return nil
+}
+
+// VerifyMFA finishes the login started with the password and signs the user
+// in once the second factor is accepted.
+func VerifyMFA(input VerifyMFAInput) (LoginUserOutput, error) {
+	claims, err := parseMFAToken(input.MFAToken)
+	if err != nil {
+		return LoginUserOutput{}, err
+	}
+
+	user, err := FindUserByID(claims.ID)
+	if err != nil || !user.MFAEnabled {
+		return LoginUserOutput{}, ErrInvalidMFAToken
+	}
+
+	if err := countMFAAttempt(claims.ID); err != nil {
+		return LoginUserOutput{}, err
+	}
+
+	switch {
+	case input.Code != "":
+		err = useTOTPCode(user, input.Code)
+	case input.RecoveryCode != "":
+		err = useRecoveryCode(user, input.RecoveryCode)
+	default:
+		err = ErrInvalidMFACode
+	}
+	if err != nil {
+		return LoginUserOutput{}, err
+	}
+
+	if err := RedisClient.Del(context.Background(), mfaUserAttemptsKey(claims.ID)).Err(); err != nil {
+		log.Printf("[VerifyMFA] %v", err)
+	}
+
+	// the login token is done once it signed the user in
+	if err := RevokeToken(claims); err != nil {
+		log.Printf("[VerifyMFA] %v", err)
+	}
+
+	tokens, err := CreateSession(user, input.Client)
+	if err != nil {
+		return LoginUserOutput{}, err
+	}
+
+	return LoginUserOutput{
+		User:       *user,
+		AuthTokens: *tokens,
+	}, nil
+}
+
+// EnrollTOTP starts the enrollment of an authenticator app, two factor
+// authentication is only enabled once a code of the app is confirmed.
+func EnrollTOTP(user *User) (*EnrollTOTPOutput, error) {
+	if user.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return nil, fmt.Errorf("[EnrollTOTP] %v", err)
+	}
+
+	filter := bson.M{
+		"_id":        user.ID,
+		"mfaEnabled": bson.M{"$ne": true},
+	}
+	update := bson.M{
+		"$set": bson.M{"totpPendingSecret": secret},
+	}
+
+	res, err := MongoDatabase.Collection(users).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return nil, fmt.Errorf("[EnrollTOTP] %v", err)
+	}
+	if res.MatchedCount == 0 {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	return &EnrollTOTPOutput{
+		Secret: secret,
+		URI:    TOTPURI(secret, user.Username),
+	}, nil
+}
+
+// ConfirmTOTP enables two factor authentication with the code of the app
+// being enrolled and returns the recovery codes, they aren't shown again.
+func ConfirmTOTP(user *User, input ConfirmTOTPInput) (*ConfirmTOTPOutput, error) {
+	if user.MFAEnabled {
+		return nil, ErrMFAAlreadyEnabled
+	}
+
+	if user.TOTPPendingSecret == "" {
+		return nil, ErrMFANotEnrolled
+	}
+
+	counter, ok := VerifyTOTP(user.TOTPPendingSecret, input.Code, time.Now())
+	if !ok {
+		return nil, ErrInvalidMFACode
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("[ConfirmTOTP] %v", err)
+	}
+
+	// the secret confirmed is the one the code was checked with, a new
+	// enrollment started in the meantime makes the update miss
+	filter := bson.M{
+		"_id":               user.ID,
+		"totpPendingSecret": user.TOTPPendingSecret,
+		"mfaEnabled":        bson.M{"$ne": true},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"mfaEnabled":      true,
+			"totpSecret":      user.TOTPPendingSecret,
+			"totpLastCounter": counter,
+			"recoveryCodes":   hashes,
+			"updatedAt":       time.Now(),
+		},
+		"$unset": bson.M{"totpPendingSecret": ""},
+	}
+
+	res, err := MongoDatabase.Collection(users).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return nil, fmt.Errorf("[ConfirmTOTP] %v", err)
+	}
+	if res.MatchedCount == 0 {
+		return nil, ErrMFANotEnrolled
+	}
+
+	return &ConfirmTOTPOutput{
+		RecoveryCodes: codes,
+	}, nil
+}
+
+func mfaErrorStatus(err error) int {
+	switch err {
+	case ErrInvalidMFAToken:
+		return 401
+	case ErrMFAAlreadyEnabled, ErrMFANotEnrolled, ErrInvalidMFACode:
+		return 422
+	case ErrTooManyRequests:
+		return 429
+	}
+
+	return 500
+}
+
+func (f *UserFunc) VerifyMFAHandler(ctx *gin.Context) {
+	input := VerifyMFAInput{}
+	if err := ctx.ShouldBind(&input); err != nil || input.MFAToken == "" {
+		log.Printf("[VerifyMFAHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "User authentication failed, please check your request data",
+		})
+		return
+	}
+	input.Client = NewSessionClient(ctx)
+
+	loginOut, err := f.VerifyMFAFunc(input)
+	if err != nil {
+		log.Printf("[VerifyMFAHandler] %v", err)
+		message := "User authentication failed, not authorized"
+		if err == ErrInvalidMFAToken || err == ErrInvalidMFACode || err == ErrTooManyRequests {
+			message = err.Error()
+		}
+		ctx.JSON(mfaErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": message,
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "User authenticated",
+		"data":    loginOut,
+	})
+}
+
+func (f *UserFunc) EnrollTOTPHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[EnrollTOTPHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to enroll authenticator app",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	out, err := f.EnrollTOTPFunc(user)
+	if err != nil {
+		log.Printf("[EnrollTOTPHandler] %v", err)
+		ctx.JSON(mfaErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to enroll authenticator app",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Scan the QR code with your authenticator app, then confirm it with a code",
+		"data":    out,
+	})
+}
+
+func (f *UserFunc) ConfirmTOTPHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[ConfirmTOTPHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to confirm authenticator app",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := ConfirmTOTPInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[ConfirmTOTPHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to confirm authenticator app, please check your request data",
+		})
+		return
+	}
+
+	out, err := f.ConfirmTOTPFunc(user, input)
+	if err != nil {
+		log.Printf("[ConfirmTOTPHandler] %v", err)
+		ctx.JSON(mfaErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to confirm authenticator app",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Two factor authentication enabled, keep the recovery codes somewhere safe",
+		"data":    out,
+	})
+}
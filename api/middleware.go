@@ -1,6 +1,7 @@
 package api
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"strings"
@@ -9,113 +10,104 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-func AuthenticateWS() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		authToken := ctx.Query("authToken")
-		if authToken == "" {
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
-		}
+var (
+	ErrTokenRevoked = errors.New("token was revoked")
+	ErrTokenInvalid = errors.New("token is missing required claims")
+)
 
-		token, err := jwt.Parse(authToken, func(token *jwt.Token) (interface{}, error) {
-			if method, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("failed get signing method")
-			} else if method != JwtSigningMethod {
-				return nil, fmt.Errorf("signing method not match")
-			}
-
-			return JwtSecretKey, nil
-		})
-
-		if err != nil {
-			log.Printf("[AuthenticateUser] %v", err)
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
-		}
+func authKeyFunc(token *jwt.Token) (interface{}, error) {
+	if method, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("failed get signing method")
+	} else if method != JwtSigningMethod {
+		return nil, fmt.Errorf("signing method not match")
+	}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
-		}
+	return JwtSecretKey, nil
+}
 
-		userID := claims["id"].(string)
-		user, err := FindUserByID(userID)
-		if err != nil {
-			log.Printf("[AuthenticateUser] %v", err)
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
-		}
+// ParseAuthToken verifies the signature, expiry and revocation of the token
+// and returns its claims.
+func ParseAuthToken(authToken string) (*AuthClaims, error) {
+	claims := &AuthClaims{}
+	token, err := jwt.ParseWithClaims(authToken, claims, authKeyFunc)
+	if err != nil {
+		return nil, err
+	}
 
-		ctx.Set("user", user)
-		ctx.Next()
+	if !token.Valid {
+		return nil, ErrTokenInvalid
 	}
+
+	if claims.MFAPending {
+		return nil, ErrMFARequired
+	}
+
+	// tokens issued before they carried an ID can't be revoked
+	if claims.ID == "" || claims.RegisteredClaims.ID == "" || claims.SessionID == "" {
+		return nil, ErrTokenInvalid
+	}
+
+	revoked, err := IsTokenRevoked(claims)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
 }
 
-func AuthenticateUser() gin.HandlerFunc {
-	return func(ctx *gin.Context) {
-		authHeader := ctx.GetHeader("Authorization")
-		if hasPrefix := strings.Contains(authHeader, "Bearer"); !hasPrefix {
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
-		}
+// authenticate sets the user of the token on the context, or aborts the
+// request when the token isn't accepted.
+func authenticate(ctx *gin.Context, authToken string) {
+	if authToken == "" {
+		unauthorized(ctx)
+		return
+	}
 
-		auth := strings.Split(authHeader, " ")
-		token, err := jwt.Parse(auth[1], func(token *jwt.Token) (interface{}, error) {
-			if method, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("failed get signing method")
-			} else if method != JwtSigningMethod {
-				return nil, fmt.Errorf("signing method not match")
-			}
-
-			return JwtSecretKey, nil
-		})
-
-		if err != nil {
-			log.Printf("[AuthenticateUser] %v", err)
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
-		}
+	claims, err := ParseAuthToken(authToken)
+	if err != nil {
+		log.Printf("[authenticate] %v", err)
+		unauthorized(ctx)
+		return
+	}
 
-		claims, ok := token.Claims.(jwt.MapClaims)
-		if !ok || !token.Valid {
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
-		}
+	user, err := FindUserByID(claims.ID)
+	if err != nil {
+		log.Printf("[authenticate] %v", err)
+		unauthorized(ctx)
+		return
+	}
 
-		userID := claims["id"].(string)
-		user, err := FindUserByID(userID)
-		if err != nil {
-			log.Printf("[AuthenticateUser] %v", err)
-			ctx.JSON(401, gin.H{
-				"status":  "error",
-				"message": "Unauthorized",
-			})
-			ctx.Abort()
+	ctx.Set("user", user)
+	ctx.Set("claims", claims)
+	ctx.Set("sessionId", claims.SessionID)
+	ctx.Next()
+}
+
+func unauthorized(ctx *gin.Context) {
+	ctx.AbortWithStatusJSON(401, gin.H{
+		"status":  "error",
+		"message": "Unauthorized",
+	})
+}
+
+func AuthenticateWS() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		authenticate(ctx, ctx.Query("authToken"))
+	}
+}
+
+func AuthenticateUser() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		authHeader := ctx.GetHeader("Authorization")
+		if !strings.HasPrefix(authHeader, "Bearer ") {
+			unauthorized(ctx)
+			return
 		}
 
-		ctx.Set("user", user)
-		ctx.Next()
+		authToken := strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+		authenticate(ctx, authToken)
 	}
 }
@@ -0,0 +1,234 @@
+package api
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type (
+	ForgotPasswordInput struct {
+		Email string `json:"email" validate:"required,email"`
+	}
+
+	ResetPasswordInput struct {
+		Token                string `json:"token" validate:"required"`
+		Password             string `json:"password" validate:"required,min=8"`
+		PasswordConfirmation string `json:"passwordConfirmation" validate:"required"`
+	}
+)
+
+var (
+	ErrInvalidResetToken = errors.New("password reset token is invalid or expired")
+	ErrPasswordTooShort  = errors.New("password should be at least 8 characters")
+	ErrPasswordMismatch  = errors.New("your password and confirmation password doesn't match")
+)
+
+var (
+	PasswordResetExpDuration = time.Duration(1) * time.Hour
+)
+
+// consumeResetToken removes the stored token only when it matches, so a
+// token can't be used twice and a wrong one doesn't void the link.
+var consumeResetToken = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func passwordResetKey(userID string) string {
+	return fmt.Sprintf("password_reset:%s", userID)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// FindUserByEmail looks the address up ignoring case, accounts registered
+// before addresses were stored lowercase may have mixed case.
+func FindUserByEmail(email string) (*User, error) {
+	filter := bson.M{
+		"email": normalizeEmail(email),
+	}
+	opts := options.FindOne().SetCollation(&options.Collation{Locale: "en", Strength: 2})
+
+	var user User
+	if err := MongoDatabase.Collection(users).FindOne(context.Background(), filter, opts).Decode(&user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+// ForgotPassword emails a reset link to the user of the address. It succeeds
+// whether the address is registered or not, so it can't be used to find out
+// who has an account.
+func ForgotPassword(input ForgotPasswordInput) error {
+	user, err := FindUserByEmail(input.Email)
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("[ForgotPassword] %v", err)
+	}
+
+	// a new link replaces the previous one
+	token := GenSecureToken(32)
+	fmtToken := fmt.Sprintf("%s$%s", user.ID.Hex(), token)
+	encToken := base64.URLEncoding.EncodeToString([]byte(fmtToken))
+	if err := RedisClient.Set(context.Background(), passwordResetKey(user.ID.Hex()), hashToken(token), PasswordResetExpDuration).Err(); err != nil {
+		return fmt.Errorf("[ForgotPassword] %v", err)
+	}
+
+	go sendPasswordResetEmail(user.Email, encToken)
+	return nil
+}
+
+func sendPasswordResetEmail(to, token string) {
+	urlVal := url.Values{}
+	urlVal.Set("token", token)
+	body := fmt.Sprintf(`
+	<div>
+		<p>Someone asked to reset the password of your account. Click link below to choose a new one</p>
+		<p>%s</p>
+		<p>The link expires in an hour, you can ignore this email if it wasn't you.</p>
+	</div>
+	`, AppConfig.PasswordResetURL+"?"+urlVal.Encode())
+
+	if err := sendEmail(to, "Reset your password - Talkbox", body); err != nil {
+		log.Printf("[sendPasswordResetEmail] %v", err)
+		return
+	}
+	log.Printf("[sendPasswordResetEmail] Password reset email successfully sent to %s", to)
+}
+
+// ResetPassword sets the new password with the token from the reset link.
+// The token is removed as it is read, so a link works only once, and every
+// session of the user is signed out.
+func ResetPassword(input ResetPasswordInput) error {
+	if len(input.Password) < 8 {
+		return ErrPasswordTooShort
+	}
+
+	if input.Password != input.PasswordConfirmation {
+		return ErrPasswordMismatch
+	}
+
+	decodedToken, err := base64.URLEncoding.DecodeString(input.Token)
+	if err != nil {
+		return ErrInvalidResetToken
+	}
+
+	userID, userToken, ok := strings.Cut(string(decodedToken), "$")
+	if !ok {
+		return ErrInvalidResetToken
+	}
+
+	// only the request that removes the token may use it
+	deleted, err := consumeResetToken.Run(context.Background(), RedisClient, []string{passwordResetKey(userID)}, hashToken(userToken)).Int()
+	if err != nil {
+		return fmt.Errorf("[ResetPassword] %v", err)
+	}
+	if deleted == 0 {
+		return ErrInvalidResetToken
+	}
+
+	user, err := FindUserByID(userID)
+	if err != nil {
+		return ErrInvalidResetToken
+	}
+
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("[ResetPassword] %v", err)
+	}
+
+	update := bson.M{
+		"$set": bson.M{
+			"password":  string(hashPassword),
+			"updatedAt": time.Now(),
+		},
+	}
+	if _, err := MongoDatabase.Collection(users).UpdateByID(context.Background(), user.ID, update); err != nil {
+		return fmt.Errorf("[ResetPassword] %v", err)
+	}
+
+	if err := RevokeUserTokens(userID); err != nil {
+		return fmt.Errorf("[ResetPassword] %v", err)
+	}
+
+	return nil
+}
+
+func (f *UserFunc) ForgotPasswordHandler(ctx *gin.Context) {
+	input := ForgotPasswordInput{}
+	if err := ctx.ShouldBind(&input); err != nil || input.Email == "" {
+		log.Printf("[ForgotPasswordHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to request password reset, please check your request data",
+		})
+		return
+	}
+
+	if err := f.ForgotPasswordFunc(input); err != nil {
+		log.Printf("[ForgotPasswordHandler] %v", err)
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "If the email is registered, a link to reset the password has been sent",
+	})
+}
+
+func (f *UserFunc) ResetPasswordHandler(ctx *gin.Context) {
+	input := ResetPasswordInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[ResetPasswordHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to reset password, please check your request data",
+		})
+		return
+	}
+
+	if err := f.ResetPasswordFunc(input); err != nil {
+		log.Printf("[ResetPasswordHandler] %v", err)
+		switch err {
+		case ErrPasswordTooShort, ErrPasswordMismatch:
+			ctx.JSON(422, gin.H{
+				"status":  "error",
+				"message": err.Error(),
+			})
+		case ErrInvalidResetToken:
+			ctx.JSON(422, gin.H{
+				"status":  "error",
+				"message": "Failed to reset password, the link is invalid or expired",
+			})
+		default:
+			ctx.JSON(500, gin.H{
+				"status":  "error",
+				"message": "Failed to reset password",
+			})
+		}
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Password successfully reset, please login with your new password",
+	})
+}
@@ -0,0 +1,314 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	PinnedMessage struct {
+		MessageID primitive.ObjectID `bson:"messageId" json:"messageId"`
+		PinnedBy  primitive.ObjectID `bson:"pinnedBy" json:"pinnedBy"`
+		PinnedAt  time.Time          `bson:"pinnedAt" json:"pinnedAt"`
+
+		// filled when the pins of a room are listed
+		Message *Message `bson:"-" json:"message,omitempty"`
+	}
+
+	PinPayload struct {
+		RoomID    string         `json:"roomId"`
+		MessageID string         `json:"messageId"`
+		ActorID   string         `json:"actorId"`
+		Pin       *PinnedMessage `json:"pin,omitempty"`
+	}
+)
+
+var (
+	ErrTooManyPins = errors.New("room reached the maximum number of pinned messages")
+)
+
+var (
+	MaxPinnedMessages = 50
+)
+
+// PinMessage pins a message of the room for every participant, pinning a
+// message twice keeps the first pin.
+func PinMessage(user *User, roomID, messageID string) (*PinnedMessage, error) {
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	message, err := FindMessageByID(messageID)
+	if err != nil || message.RoomID != room.ID || message.DeletedAt != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	if pin := room.FindPin(message.ID); pin != nil {
+		pin.Message = message
+		return pin, nil
+	}
+
+	pin := PinnedMessage{
+		MessageID: message.ID,
+		PinnedBy:  user.ID,
+		PinnedAt:  time.Now(),
+	}
+
+	// the size check and the duplicate check are part of the filter, so two
+	// concurrent pins can't go over the limit or pin the same message twice
+	filter := bson.M{
+		"_id":                      room.ID,
+		"pinnedMessages.messageId": bson.M{"$ne": message.ID},
+		fmt.Sprintf("pinnedMessages.%d", MaxPinnedMessages-1): bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$push": bson.M{"pinnedMessages": pin},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var updated Room
+	err = MongoDatabase.Collection(rooms).FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&updated)
+	if err == mongo.ErrNoDocuments {
+		room, err = FindRoomByID(roomID)
+		if err != nil {
+			return nil, fmt.Errorf("[PinMessage] %v", err)
+		}
+
+		if existing := room.FindPin(message.ID); existing != nil {
+			existing.Message = message
+			return existing, nil
+		}
+		return nil, ErrTooManyPins
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[PinMessage] %v", err)
+	}
+
+	pin.Message = message
+	SendEvent(roomID, updated.ParticipantIDs(), NewEvent(MessagePinned, PinPayload{
+		RoomID:    roomID,
+		MessageID: messageID,
+		ActorID:   user.ID.Hex(),
+		Pin:       &pin,
+	}))
+
+	return &pin, nil
+}
+
+func UnpinMessage(user *User, roomID, messageID string) error {
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return err
+	}
+
+	msgObjID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return ErrMessageNotFound
+	}
+
+	return unpinMessage(room, msgObjID, user.ID)
+}
+
+// unpinMessage removes the pin and tells the room, removing a message that
+// isn't pinned does nothing.
+func unpinMessage(room *Room, messageID, actorID primitive.ObjectID) error {
+	filter := bson.M{
+		"_id":                      room.ID,
+		"pinnedMessages.messageId": messageID,
+	}
+	update := bson.M{
+		"$pull": bson.M{"pinnedMessages": bson.M{"messageId": messageID}},
+	}
+
+	res, err := MongoDatabase.Collection(rooms).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return fmt.Errorf("[unpinMessage] %v", err)
+	}
+
+	if res.ModifiedCount == 0 {
+		return nil
+	}
+
+	SendEvent(room.ID.Hex(), room.ParticipantIDs(), NewEvent(MessageUnpinned, PinPayload{
+		RoomID:    room.ID.Hex(),
+		MessageID: messageID.Hex(),
+		ActorID:   actorID.Hex(),
+	}))
+
+	return nil
+}
+
+func (r *Room) FindPin(messageID primitive.ObjectID) *PinnedMessage {
+	for i := range r.PinnedMessages {
+		if r.PinnedMessages[i].MessageID == messageID {
+			return &r.PinnedMessages[i]
+		}
+	}
+
+	return nil
+}
+
+// fillPinnedMessages loads the pinned messages of the room, newest pin first.
+// Pins of messages that can't be shown anymore are left out.
+func fillPinnedMessages(room *Room) error {
+	if len(room.PinnedMessages) == 0 {
+		room.PinnedMessages = []PinnedMessage{}
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(room.PinnedMessages))
+	for _, pin := range room.PinnedMessages {
+		ids = append(ids, pin.MessageID)
+	}
+
+	match := bson.D{
+		{"_id", bson.D{{"$in", ids}}},
+		{"deletedAt", bson.D{{"$exists", false}}},
+	}
+	messages, err := findMessages(match, nil, true, false, int64(len(ids)))
+	if err != nil {
+		return fmt.Errorf("[fillPinnedMessages] %v", err)
+	}
+
+	byID := make(map[primitive.ObjectID]*Message, len(messages))
+	for i := range messages {
+		messages[i].Status = messages[i].DeliveryStatus()
+		byID[messages[i].ID] = &messages[i]
+	}
+
+	pins := make([]PinnedMessage, 0, len(room.PinnedMessages))
+	for i := len(room.PinnedMessages) - 1; i >= 0; i-- {
+		pin := room.PinnedMessages[i]
+		if message, ok := byID[pin.MessageID]; ok {
+			pin.Message = message
+			pins = append(pins, pin)
+		}
+	}
+	room.PinnedMessages = pins
+
+	return nil
+}
+
+func GetPinnedMessages(user *User, roomID string) ([]PinnedMessage, error) {
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := fillPinnedMessages(room); err != nil {
+		return nil, err
+	}
+
+	for i := range room.PinnedMessages {
+		message := room.PinnedMessages[i].Message
+		message.ReactionSummaries = SummarizeReactions(message.Reactions, &user.ID)
+	}
+
+	return room.PinnedMessages, nil
+}
+
+func pinErrorStatus(err error) int {
+	switch err {
+	case ErrMessageNotFound:
+		return 404
+	case ErrTooManyPins:
+		return 422
+	}
+
+	return roomErrorStatus(err)
+}
+
+func (f *RoomFunc) PinMessageHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[PinMessageHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to pin message",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	pin, err := f.PinMessageFunc(user, ctx.Param("room_id"), ctx.Param("message_id"))
+	if err != nil {
+		log.Printf("[PinMessageHandler] %v", err)
+		ctx.JSON(pinErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to pin message",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully pin message",
+		"data":    pin,
+	})
+}
+
+func (f *RoomFunc) UnpinMessageHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[UnpinMessageHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to unpin message",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	if err := f.UnpinMessageFunc(user, ctx.Param("room_id"), ctx.Param("message_id")); err != nil {
+		log.Printf("[UnpinMessageHandler] %v", err)
+		ctx.JSON(pinErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to unpin message",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully unpin message",
+	})
+}
+
+func (f *RoomFunc) GetPinnedMessagesHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[GetPinnedMessagesHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to get pinned messages",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	pins, err := f.GetPinnedMessagesFunc(user, ctx.Param("room_id"))
+	if err != nil {
+		log.Printf("[GetPinnedMessagesHandler] %v", err)
+		ctx.JSON(pinErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to get pinned messages",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully get pinned messages",
+		"data":    pins,
+	})
+}
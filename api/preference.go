@@ -0,0 +1,252 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	// UpdateRoomPreferencesInput changes the fields that are set and leaves
+	// the others as they are. Muting without an end time mutes the room until
+	// it is unmuted.
+	UpdateRoomPreferencesInput struct {
+		Archived   *bool      `json:"archived"`
+		Favorite   *bool      `json:"favorite"`
+		Muted      *bool      `json:"muted"`
+		MutedUntil *time.Time `json:"mutedUntil"`
+		Position   *int       `json:"position"`
+	}
+
+	RoomPreferences struct {
+		RoomID     string     `json:"roomId"`
+		Archived   bool       `json:"archived"`
+		Muted      bool       `json:"muted"`
+		MutedUntil *time.Time `json:"mutedUntil"`
+		Favorite   bool       `json:"favorite"`
+		Position   int        `json:"position"`
+	}
+)
+
+var (
+	ErrInvalidMuteTime         = errors.New("room should be muted until a time in the future")
+	ErrInvalidRoomFilter       = errors.New("room filters should be true or false, archived also accepts all")
+	ErrEmptyPreferences        = errors.New("at least one preference should be given")
+	ErrPositionWithoutFavorite = errors.New("only favorite rooms can be given a position")
+)
+
+// a room muted forever is stored as muted until this time, so every muted
+// room can be matched the same way
+var mutedForever = time.Date(9999, time.December, 31, 0, 0, 0, 0, time.UTC)
+
+func (p *Participant) Preferences(roomID primitive.ObjectID) *RoomPreferences {
+	preferences := &RoomPreferences{
+		RoomID:   roomID.Hex(),
+		Archived: p.Archived,
+		Favorite: p.Favorite,
+	}
+
+	if p.Favorite {
+		preferences.Position = p.Position
+	}
+
+	if p.MutedUntil != nil && p.MutedUntil.After(time.Now()) {
+		preferences.Muted = true
+		if p.MutedUntil.Before(mutedForever) {
+			preferences.MutedUntil = p.MutedUntil
+		}
+	}
+
+	return preferences
+}
+
+// fillPreferences sets the preferences of the user on each room of the list.
+func fillPreferences(rooms []Room, userID primitive.ObjectID) {
+	for i := range rooms {
+		room := &rooms[i]
+		participant := room.FindParticipant(userID)
+		if participant == nil {
+			continue
+		}
+
+		preferences := participant.Preferences(room.ID)
+		room.Archived = preferences.Archived
+		room.Muted = preferences.Muted
+		room.MutedUntil = preferences.MutedUntil
+		room.Favorite = preferences.Favorite
+		room.Position = preferences.Position
+	}
+}
+
+// preferencesUpdate builds the update of the participant entry matched by
+// the positional operator.
+func preferencesUpdate(input UpdateRoomPreferencesInput) (bson.M, error) {
+	set := bson.M{}
+	unset := bson.M{}
+
+	if input.Archived != nil {
+		set["participants.$.archived"] = *input.Archived
+	}
+
+	// only favorite rooms are ordered, a room leaving the favorites loses its
+	// position
+	if input.Favorite != nil && !*input.Favorite && input.Position != nil {
+		return nil, ErrPositionWithoutFavorite
+	}
+
+	if input.Favorite != nil {
+		set["participants.$.favorite"] = *input.Favorite
+		if !*input.Favorite {
+			unset["participants.$.position"] = ""
+		}
+	}
+
+	if input.Position != nil {
+		set["participants.$.position"] = *input.Position
+	}
+
+	switch {
+	case input.Muted != nil && !*input.Muted:
+		unset["participants.$.mutedUntil"] = ""
+	case input.MutedUntil != nil:
+		if !input.MutedUntil.After(time.Now()) {
+			return nil, ErrInvalidMuteTime
+		}
+		set["participants.$.mutedUntil"] = *input.MutedUntil
+	case input.Muted != nil:
+		set["participants.$.mutedUntil"] = mutedForever
+	}
+
+	if len(set) == 0 && len(unset) == 0 {
+		return nil, ErrEmptyPreferences
+	}
+
+	update := bson.M{}
+	if len(set) != 0 {
+		update["$set"] = set
+	}
+	if len(unset) != 0 {
+		update["$unset"] = unset
+	}
+
+	return update, nil
+}
+
+func UpdateRoomPreferences(user *User, roomID string, input UpdateRoomPreferencesInput) (*RoomPreferences, error) {
+	update, err := preferencesUpdate(input)
+	if err != nil {
+		return nil, err
+	}
+
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	filter := bson.M{
+		"_id":             room.ID,
+		"participants.id": user.ID,
+	}
+	if _, err := MongoDatabase.Collection(rooms).UpdateOne(context.Background(), filter, update); err != nil {
+		return nil, fmt.Errorf("[UpdateRoomPreferences] %v", err)
+	}
+
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("[UpdateRoomPreferences] %v", err)
+	}
+
+	participant := room.FindParticipant(user.ID)
+	if participant == nil {
+		return nil, ErrNotRoomParticipant
+	}
+
+	// the preferences are private, only the other sessions of the user hear
+	// about the change
+	preferences := participant.Preferences(room.ID)
+	SendEvent(roomID, []string{user.ID.Hex()}, NewEvent(RoomPreferencesUpdated, preferences))
+
+	return preferences, nil
+}
+
+func parseRoomFilter(ctx *gin.Context) (RoomFilter, error) {
+	filter := RoomFilter{
+		Archived: ArchivedExcluded,
+	}
+
+	switch archived := ArchivedFilter(ctx.Query("archived")); archived {
+	case "":
+	case ArchivedExcluded, ArchivedOnly, ArchivedAll:
+		filter.Archived = archived
+	default:
+		return filter, ErrInvalidRoomFilter
+	}
+
+	for query, field := range map[string]**bool{
+		"muted":    &filter.Muted,
+		"favorite": &filter.Favorite,
+	} {
+		value := ctx.Query(query)
+		if value == "" {
+			continue
+		}
+
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, ErrInvalidRoomFilter
+		}
+		*field = &b
+	}
+
+	return filter, nil
+}
+
+func (f *RoomFunc) UpdatePreferencesHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[UpdatePreferencesHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to update room preferences",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := UpdateRoomPreferencesInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[UpdatePreferencesHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to update room preferences, please check your request data",
+		})
+		return
+	}
+
+	preferences, err := f.UpdatePreferencesFunc(user, ctx.Param("room_id"), input)
+	if err != nil {
+		log.Printf("[UpdatePreferencesHandler] %v", err)
+		status := roomErrorStatus(err)
+		if err == ErrPositionWithoutFavorite {
+			status = 400
+		}
+		ctx.JSON(status, gin.H{
+			"status":  "error",
+			"message": "Failed to update room preferences",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully update room preferences",
+		"data":    preferences,
+	})
+}
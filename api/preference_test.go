@@ -0,0 +1,57 @@
+package api
+
+import (
+	"testing"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestPreferencesUpdateRejectsPositionWithoutFavorite(t *testing.T) {
+	favorite := false
+	position := 2
+
+	_, err := preferencesUpdate(UpdateRoomPreferencesInput{
+		Favorite: &favorite,
+		Position: &position,
+	})
+	if err != ErrPositionWithoutFavorite {
+		t.Errorf("preferencesUpdate() error = %v, want %v", err, ErrPositionWithoutFavorite)
+	}
+}
+
+func TestPreferencesUpdateFavoritePosition(t *testing.T) {
+	favorite := true
+	position := 2
+
+	update, err := preferencesUpdate(UpdateRoomPreferencesInput{
+		Favorite: &favorite,
+		Position: &position,
+	})
+	if err != nil {
+		t.Fatalf("preferencesUpdate() error = %v", err)
+	}
+
+	set, _ := update["$set"].(bson.M)
+	if set["participants.$.favorite"] != true || set["participants.$.position"] != 2 {
+		t.Errorf("preferencesUpdate() $set = %v", set)
+	}
+	if _, ok := update["$unset"]; ok {
+		t.Errorf("preferencesUpdate() unsets %v", update["$unset"])
+	}
+}
+
+func TestPreferencesUpdateUnfavoriteDropsPosition(t *testing.T) {
+	favorite := false
+
+	update, err := preferencesUpdate(UpdateRoomPreferencesInput{
+		Favorite: &favorite,
+	})
+	if err != nil {
+		t.Fatalf("preferencesUpdate() error = %v", err)
+	}
+
+	unset, _ := update["$unset"].(bson.M)
+	if _, ok := unset["participants.$.position"]; !ok {
+		t.Errorf("preferencesUpdate() $unset = %v, want the position removed", unset)
+	}
+}
@@ -0,0 +1,292 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	PresenceStatus string
+
+	Presence struct {
+		UserID     string         `json:"userId"`
+		Status     PresenceStatus `json:"status"`
+		LastSeenAt *time.Time     `json:"lastSeenAt"`
+	}
+)
+
+const (
+	Online  PresenceStatus = "online"
+	Away    PresenceStatus = "away"
+	Offline PresenceStatus = "offline"
+)
+
+var (
+	// a session is kept alive by the pong answering every ping, one that
+	// misses a whole round is considered gone
+	PresenceExpDuration = pongWait + writeWait
+	// a user with a live session but no activity for this long is away
+	AwayAfterDuration = time.Duration(5) * time.Minute
+)
+
+// presenceSessionsKey holds the websocket sessions of the user as a sorted set
+// scored by the time they expire, so the sessions of an instance that died
+// without cleaning up drop out on their own.
+func presenceSessionsKey(userID string) string {
+	return fmt.Sprintf("presence:sessions:%s", userID)
+}
+
+// presenceActiveKey holds the unix milli time of the last event the user sent.
+func presenceActiveKey(userID string) string {
+	return fmt.Sprintf("presence:active:%s", userID)
+}
+
+// presenceStatusKey holds the last status broadcast for the user, it keeps the
+// instances from announcing the same change twice.
+func presenceStatusKey(userID string) string {
+	return fmt.Sprintf("presence:status:%s", userID)
+}
+
+func touchPresenceSession(c *Client, active bool) error {
+	key := presenceSessionsKey(c.UserID)
+	now := time.Now()
+
+	pipe := RedisClient.TxPipeline()
+	pipe.ZAdd(context.Background(), key, redis.Z{
+		Score:  float64(now.Add(PresenceExpDuration).UnixMilli()),
+		Member: c.ID,
+	})
+	pipe.Expire(context.Background(), key, PresenceExpDuration)
+	if active {
+		pipe.Set(context.Background(), presenceActiveKey(c.UserID), now.UnixMilli(), PresenceExpDuration+AwayAfterDuration)
+	}
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return fmt.Errorf("[touchPresenceSession] %v", err)
+	}
+
+	return nil
+}
+
+// PresenceConnect registers a new session of the user, the user becomes
+// online when it is the first one.
+func PresenceConnect(c *Client) {
+	if err := touchPresenceSession(c, true); err != nil {
+		log.Printf("[PresenceConnect] %v", err)
+		return
+	}
+
+	refreshPresence(c.UserID)
+}
+
+// PresenceHeartbeat keeps the session alive, it also turns an idle user away.
+func PresenceHeartbeat(c *Client) {
+	if err := touchPresenceSession(c, false); err != nil {
+		log.Printf("[PresenceHeartbeat] %v", err)
+		return
+	}
+
+	refreshPresence(c.UserID)
+}
+
+// PresenceActivity records that the user did something on the session, which
+// brings an away user back online.
+func PresenceActivity(c *Client) {
+	if err := touchPresenceSession(c, true); err != nil {
+		log.Printf("[PresenceActivity] %v", err)
+		return
+	}
+
+	refreshPresence(c.UserID)
+}
+
+// PresenceDisconnect removes the session, the user goes offline once the last
+// session is gone and the time is kept as the last seen time.
+func PresenceDisconnect(c *Client) {
+	if err := RedisClient.ZRem(context.Background(), presenceSessionsKey(c.UserID), c.ID).Err(); err != nil {
+		log.Printf("[PresenceDisconnect] %v", err)
+		return
+	}
+
+	refreshPresence(c.UserID)
+}
+
+func findPresenceStatus(userID string) (PresenceStatus, error) {
+	now := time.Now()
+	key := presenceSessionsKey(userID)
+
+	pipe := RedisClient.Pipeline()
+	pipe.ZRemRangeByScore(context.Background(), key, "-inf", strconv.FormatInt(now.UnixMilli(), 10))
+	sessions := pipe.ZCard(context.Background(), key)
+	active := pipe.Get(context.Background(), presenceActiveKey(userID))
+	if _, err := pipe.Exec(context.Background()); err != nil && err != redis.Nil {
+		return Offline, fmt.Errorf("[findPresenceStatus] %v", err)
+	}
+
+	if sessions.Val() == 0 {
+		return Offline, nil
+	}
+
+	activeAt, _ := active.Int64()
+	if now.Sub(time.UnixMilli(activeAt)) > AwayAfterDuration {
+		return Away, nil
+	}
+
+	return Online, nil
+}
+
+// refreshPresence works out the current status of the user and tells the
+// people sharing a room with the user when it changed.
+func refreshPresence(userID string) {
+	status, err := findPresenceStatus(userID)
+	if err != nil {
+		log.Printf("[refreshPresence] %v", err)
+		return
+	}
+
+	prev, err := RedisClient.GetSet(context.Background(), presenceStatusKey(userID), string(status)).Result()
+	if err != nil && err != redis.Nil {
+		log.Printf("[refreshPresence] %v", err)
+		return
+	}
+
+	if PresenceStatus(prev) == status {
+		return
+	}
+
+	presence := Presence{
+		UserID: userID,
+		Status: status,
+	}
+	if status == Offline {
+		now := time.Now()
+		presence.LastSeenAt = &now
+		if err := SaveLastSeen(userID, now); err != nil {
+			log.Printf("[refreshPresence] %v", err)
+		}
+	}
+
+	contactIDs, err := FindContactIDs(userID)
+	if err != nil {
+		log.Printf("[refreshPresence] %v", err)
+		return
+	}
+
+	SendUserEvent(contactIDs, NewEvent(PresenceChanged, presence))
+}
+
+func SaveLastSeen(userID string, at time.Time) error {
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("[SaveLastSeen] %v", err)
+	}
+
+	_, err = MongoDatabase.Collection(users).UpdateOne(context.Background(), bson.M{"_id": objID}, bson.M{
+		"$set": bson.M{"lastSeenAt": at},
+	})
+	if err != nil {
+		return fmt.Errorf("[SaveLastSeen] %v", err)
+	}
+
+	return nil
+}
+
+// FindContactIDs returns the users sharing at least one room with the user.
+func FindContactIDs(userID string) ([]string, error) {
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return []string{}, fmt.Errorf("[FindContactIDs] %v", err)
+	}
+
+	values, err := MongoDatabase.Collection(rooms).Distinct(context.Background(), "participants.id", bson.M{
+		"participants.id": objID,
+	})
+	if err != nil {
+		return []string{}, fmt.Errorf("[FindContactIDs] %v", err)
+	}
+
+	ids := make([]string, 0, len(values))
+	for _, value := range values {
+		id, ok := value.(primitive.ObjectID)
+		if !ok || id == objID {
+			continue
+		}
+		ids = append(ids, id.Hex())
+	}
+
+	return ids, nil
+}
+
+// FindPresences returns the presence of each listed user, the last seen time
+// only matters for offline users so it is left empty for the others.
+func FindPresences(userIDs []string) (map[string]Presence, error) {
+	presences := make(map[string]Presence, len(userIDs))
+	offlineIDs := make([]string, 0, len(userIDs))
+	for _, userID := range userIDs {
+		status, err := findPresenceStatus(userID)
+		if err != nil {
+			return presences, err
+		}
+
+		presences[userID] = Presence{
+			UserID: userID,
+			Status: status,
+		}
+		if status == Offline {
+			offlineIDs = append(offlineIDs, userID)
+		}
+	}
+
+	if len(offlineIDs) == 0 {
+		return presences, nil
+	}
+
+	offlineUsers, err := FindUsersByIDs(offlineIDs)
+	if err != nil {
+		return presences, fmt.Errorf("[FindPresences] %v", err)
+	}
+
+	for _, user := range offlineUsers {
+		presence := presences[user.ID.Hex()]
+		presence.LastSeenAt = user.LastSeenAt
+		presences[user.ID.Hex()] = presence
+	}
+
+	return presences, nil
+}
+
+// fillPresence sets the presence of every participant of the rooms.
+func fillPresence(rooms []Room) error {
+	seen := make(map[string]bool)
+	userIDs := make([]string, 0)
+	for _, room := range rooms {
+		for _, id := range room.ParticipantIDs() {
+			if !seen[id] {
+				seen[id] = true
+				userIDs = append(userIDs, id)
+			}
+		}
+	}
+
+	presences, err := FindPresences(userIDs)
+	if err != nil {
+		return err
+	}
+
+	for i := range rooms {
+		for j := range rooms[i].Participants {
+			participant := &rooms[i].Participants[j]
+			if presence, ok := presences[participant.ID.Hex()]; ok {
+				participant.Presence = &presence
+			}
+		}
+	}
+
+	return nil
+}
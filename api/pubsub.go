@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"github.com/go-redis/redis/v9"
+)
+
+type (
+	// hubMessage is exchanged between api instances over redis, every
+	// instance delivers it to the sessions of the listed users it holds.
+	hubMessage struct {
+		UserIDs []string        `json:"userIds"`
+		Data    json.RawMessage `json:"data"`
+		Receipt *hubReceipt     `json:"receipt,omitempty"`
+		// ID of the event in the stream of every recipient
+		EventIDs map[string]string `json:"eventIds,omitempty"`
+		// set instead of the data when tokens were revoked
+		Revocation *hubRevocation `json:"revocation,omitempty"`
+	}
+
+	// hubReceipt asks the instances to record a delivery receipt for every
+	// recipient once a session of the recipient wrote the message out.
+	hubReceipt struct {
+		MessageID string `json:"messageId"`
+		SenderID  string `json:"senderId"`
+	}
+)
+
+const (
+	hubChannelPrefix = "hub:"
+)
+
+func roomChannel(roomID string) string {
+	return fmt.Sprintf("%sroom:%s", hubChannelPrefix, roomID)
+}
+
+// usersChannel carries the events that aren't tied to a single room.
+func usersChannel() string {
+	return fmt.Sprintf("%susers", hubChannelPrefix)
+}
+
+// Publish sends the value to the listed users through the room channel, so it
+// reaches their sessions on every api instance. When redis is unavailable the
+// value is still delivered to the sessions held by this instance.
+func (h *Hub) Publish(roomID string, userIDs []string, v interface{}) {
+	h.publish(roomChannel(roomID), userIDs, v, nil)
+}
+
+// PublishToUsers sends the value to the listed users regardless of the room
+// their sessions are opened in.
+func (h *Hub) PublishToUsers(userIDs []string, v interface{}) {
+	h.publish(usersChannel(), userIDs, v, nil)
+}
+
+// PublishMessage publishes a newly sent chat message, the recipients that
+// receive it are recorded as delivered and the sender gets notified.
+func (h *Hub) PublishMessage(roomID string, userIDs []string, v interface{}, messageID, senderID string) {
+	h.publish(roomChannel(roomID), userIDs, v, &hubReceipt{
+		MessageID: messageID,
+		SenderID:  senderID,
+	})
+}
+
+func (h *Hub) publish(channel string, userIDs []string, v interface{}, receipt *hubReceipt) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[Hub.Publish] %v", err)
+		return
+	}
+
+	msg := hubMessage{
+		UserIDs: userIDs,
+		Data:    data,
+		Receipt: receipt,
+	}
+
+	if event, ok := v.(Event); ok && event.Type.Replayable() && RedisClient != nil {
+		eventIDs, err := AppendUserEvents(userIDs, data)
+		if err != nil {
+			log.Printf("[Hub.Publish] %v", err)
+		}
+		msg.EventIDs = eventIDs
+	}
+
+	h.dispatch(channel, msg)
+}
+
+// dispatch sends the message to every instance through redis.
+func (h *Hub) dispatch(channel string, msg hubMessage) {
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("[Hub.Publish] %v", err)
+		return
+	}
+
+	if RedisClient == nil {
+		h.receive(msg)
+		return
+	}
+
+	if err := RedisClient.Publish(context.Background(), channel, payload).Err(); err != nil {
+		log.Printf("[Hub.Publish] %v", err)
+		h.receive(msg)
+	}
+}
+
+// receive hands a published message to the local sessions.
+func (h *Hub) receive(msg hubMessage) {
+	if msg.Revocation != nil {
+		h.closeRevoked(*msg.Revocation)
+		return
+	}
+
+	h.deliver(msg.UserIDs, msg.Data, msg.EventIDs, msg.Receipt)
+}
+
+// Subscribe listens to every hub channel and delivers the published messages
+// to the local sessions, it blocks until the context is cancelled.
+func (h *Hub) Subscribe(ctx context.Context, client *redis.Client) {
+	pubsub := client.PSubscribe(ctx, hubChannelPrefix+"*")
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+
+			var hubMsg hubMessage
+			if err := json.Unmarshal([]byte(msg.Payload), &hubMsg); err != nil {
+				log.Printf("[Hub.Subscribe] %v", err)
+				continue
+			}
+
+			h.receive(hubMsg)
+		}
+	}
+}
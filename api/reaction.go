@@ -0,0 +1,422 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	ReactionInput struct {
+		Emoji string `json:"emoji"`
+	}
+
+	MessageReaction struct {
+		Emoji     string             `bson:"emoji" json:"emoji"`
+		UserID    primitive.ObjectID `bson:"userId" json:"userId"`
+		CreatedAt time.Time          `bson:"createdAt" json:"createdAt"`
+	}
+
+	// ReactionSummary groups the reactions of a message by emoji, in the order
+	// each emoji was first used.
+	ReactionSummary struct {
+		Emoji       string   `json:"emoji"`
+		Count       int      `json:"count"`
+		UserIDs     []string `json:"userIds"`
+		ReactedByMe bool     `json:"reactedByMe"`
+	}
+
+	ReactionPayload struct {
+		RoomID    string            `json:"roomId"`
+		MessageID string            `json:"messageId"`
+		UserID    string            `json:"userId"`
+		Emoji     string            `json:"emoji"`
+		Reactions []ReactionSummary `json:"reactions"`
+	}
+)
+
+var (
+	ErrInvalidReaction = errors.New("reaction should be a single emoji")
+)
+
+const (
+	// longest emoji sequence accepted, family and flag sequences take several
+	// code points
+	maxReactionLength = 16
+
+	zeroWidthJoiner   = '\u200d'
+	emojiPresentation = '\ufe0f'
+	combiningKeycap   = '\u20e3'
+	skinToneFirst     = '\U0001f3fb'
+	skinToneLast      = '\U0001f3ff'
+	regionalFirst     = '\U0001f1e6'
+	regionalLast      = '\U0001f1ff'
+	tagFirst          = '\U000e0020'
+	tagLast           = '\U000e007e'
+	cancelTag         = '\U000e007f'
+	blackFlag         = '\U0001f3f4'
+)
+
+// pictographic holds the code points an emoji sequence is built from, the
+// Extended_Pictographic property of the Unicode emoji data.
+var pictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x00a9, Hi: 0x00ae, Stride: 5},
+		{Lo: 0x203c, Hi: 0x2049, Stride: 13},
+		{Lo: 0x2122, Hi: 0x2139, Stride: 23},
+		{Lo: 0x2194, Hi: 0x2199, Stride: 1},
+		{Lo: 0x21a9, Hi: 0x21aa, Stride: 1},
+		{Lo: 0x231a, Hi: 0x231b, Stride: 1},
+		{Lo: 0x2328, Hi: 0x2388, Stride: 96},
+		{Lo: 0x23cf, Hi: 0x23cf, Stride: 1},
+		{Lo: 0x23e9, Hi: 0x23f3, Stride: 1},
+		{Lo: 0x23f8, Hi: 0x23fa, Stride: 1},
+		{Lo: 0x24c2, Hi: 0x24c2, Stride: 1},
+		{Lo: 0x25aa, Hi: 0x25ab, Stride: 1},
+		{Lo: 0x25b6, Hi: 0x25c0, Stride: 10},
+		{Lo: 0x25fb, Hi: 0x25fe, Stride: 1},
+		{Lo: 0x2600, Hi: 0x2605, Stride: 1},
+		{Lo: 0x2607, Hi: 0x2612, Stride: 1},
+		{Lo: 0x2614, Hi: 0x2685, Stride: 1},
+		{Lo: 0x2690, Hi: 0x2705, Stride: 1},
+		{Lo: 0x2708, Hi: 0x2712, Stride: 1},
+		{Lo: 0x2714, Hi: 0x2716, Stride: 2},
+		{Lo: 0x271d, Hi: 0x2721, Stride: 4},
+		{Lo: 0x2728, Hi: 0x2728, Stride: 1},
+		{Lo: 0x2733, Hi: 0x2734, Stride: 1},
+		{Lo: 0x2744, Hi: 0x2747, Stride: 3},
+		{Lo: 0x274c, Hi: 0x274e, Stride: 2},
+		{Lo: 0x2753, Hi: 0x2755, Stride: 1},
+		{Lo: 0x2757, Hi: 0x2757, Stride: 1},
+		{Lo: 0x2763, Hi: 0x2767, Stride: 1},
+		{Lo: 0x2795, Hi: 0x2797, Stride: 1},
+		{Lo: 0x27a1, Hi: 0x27b0, Stride: 15},
+		{Lo: 0x27bf, Hi: 0x27bf, Stride: 1},
+		{Lo: 0x2934, Hi: 0x2935, Stride: 1},
+		{Lo: 0x2b05, Hi: 0x2b07, Stride: 1},
+		{Lo: 0x2b1b, Hi: 0x2b1c, Stride: 1},
+		{Lo: 0x2b50, Hi: 0x2b55, Stride: 5},
+		{Lo: 0x3030, Hi: 0x303d, Stride: 13},
+		{Lo: 0x3297, Hi: 0x3299, Stride: 2},
+	},
+	R32: []unicode.Range32{
+		{Lo: 0x1f000, Hi: 0x1f0ff, Stride: 1},
+		{Lo: 0x1f10d, Hi: 0x1f10f, Stride: 1},
+		{Lo: 0x1f12f, Hi: 0x1f12f, Stride: 1},
+		{Lo: 0x1f16c, Hi: 0x1f171, Stride: 1},
+		{Lo: 0x1f17e, Hi: 0x1f17f, Stride: 1},
+		{Lo: 0x1f18e, Hi: 0x1f18e, Stride: 1},
+		{Lo: 0x1f191, Hi: 0x1f19a, Stride: 1},
+		{Lo: 0x1f1ad, Hi: 0x1f1e5, Stride: 1},
+		{Lo: 0x1f201, Hi: 0x1f20f, Stride: 1},
+		{Lo: 0x1f21a, Hi: 0x1f22f, Stride: 21},
+		{Lo: 0x1f232, Hi: 0x1f23a, Stride: 1},
+		{Lo: 0x1f23c, Hi: 0x1f23f, Stride: 1},
+		{Lo: 0x1f249, Hi: 0x1f3fa, Stride: 1},
+		{Lo: 0x1f400, Hi: 0x1f53d, Stride: 1},
+		{Lo: 0x1f546, Hi: 0x1f64f, Stride: 1},
+		{Lo: 0x1f680, Hi: 0x1f6ff, Stride: 1},
+		{Lo: 0x1f774, Hi: 0x1f77f, Stride: 1},
+		{Lo: 0x1f7d5, Hi: 0x1f7ff, Stride: 1},
+		{Lo: 0x1f80c, Hi: 0x1f80f, Stride: 1},
+		{Lo: 0x1f848, Hi: 0x1f84f, Stride: 1},
+		{Lo: 0x1f85a, Hi: 0x1f85f, Stride: 1},
+		{Lo: 0x1f888, Hi: 0x1f88f, Stride: 1},
+		{Lo: 0x1f8ae, Hi: 0x1f8ff, Stride: 1},
+		{Lo: 0x1f90c, Hi: 0x1f93a, Stride: 1},
+		{Lo: 0x1f93c, Hi: 0x1f945, Stride: 1},
+		{Lo: 0x1f947, Hi: 0x1faff, Stride: 1},
+		{Lo: 0x1fc00, Hi: 0x1fffd, Stride: 1},
+	},
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= regionalFirst && r <= regionalLast
+}
+
+func isKeycapBase(r rune) bool {
+	return (r >= '0' && r <= '9') || r == '#' || r == '*'
+}
+
+// validReaction accepts a single emoji: a flag made of two regional
+// indicators, a keycap, or pictographs joined by zero width joiners, each
+// one optionally followed by the emoji presentation selector, a skin tone or
+// a tag sequence.
+func validReaction(emoji string) bool {
+	if !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxReactionLength {
+		return false
+	}
+
+	runes := []rune(emoji)
+	if len(runes) == 0 {
+		return false
+	}
+
+	if isRegionalIndicator(runes[0]) {
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	}
+
+	if isKeycapBase(runes[0]) {
+		rest := runes[1:]
+		if len(rest) > 0 && rest[0] == emojiPresentation {
+			rest = rest[1:]
+		}
+		return len(rest) == 1 && rest[0] == combiningKeycap
+	}
+
+	i := 0
+	for {
+		if i >= len(runes) || !unicode.Is(pictographic, runes[i]) {
+			return false
+		}
+		base := runes[i]
+		i++
+
+		if i < len(runes) && runes[i] == emojiPresentation {
+			i++
+		}
+		if i < len(runes) && runes[i] >= skinToneFirst && runes[i] <= skinToneLast {
+			i++
+		}
+		// subdivision flags, a black flag followed by tag letters
+		if base == blackFlag && i < len(runes) && runes[i] >= tagFirst && runes[i] <= tagLast {
+			for i < len(runes) && runes[i] >= tagFirst && runes[i] <= tagLast {
+				i++
+			}
+			if i >= len(runes) || runes[i] != cancelTag {
+				return false
+			}
+			i++
+		}
+
+		if i == len(runes) {
+			return true
+		}
+		if runes[i] != zeroWidthJoiner {
+			return false
+		}
+		i++
+	}
+}
+
+// SummarizeReactions groups the reactions by emoji, marking the ones the user
+// took part in. A nil user leaves every flag unset.
+func SummarizeReactions(reactions []MessageReaction, userID *primitive.ObjectID) []ReactionSummary {
+	summaries := make([]ReactionSummary, 0)
+	index := make(map[string]int)
+	for _, reaction := range reactions {
+		i, ok := index[reaction.Emoji]
+		if !ok {
+			i = len(summaries)
+			index[reaction.Emoji] = i
+			summaries = append(summaries, ReactionSummary{
+				Emoji:   reaction.Emoji,
+				UserIDs: []string{},
+			})
+		}
+
+		summary := &summaries[i]
+		summary.Count++
+		summary.UserIDs = append(summary.UserIDs, reaction.UserID.Hex())
+		if userID != nil && reaction.UserID == *userID {
+			summary.ReactedByMe = true
+		}
+	}
+
+	return summaries
+}
+
+// reactionMessageFilter matches a visible message of the room.
+func reactionMessageFilter(roomID primitive.ObjectID, messageID string) (bson.M, error) {
+	msgObjID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		return nil, ErrMessageNotFound
+	}
+
+	return bson.M{
+		"_id":       msgObjID,
+		"roomId":    roomID,
+		"deletedAt": bson.M{"$exists": false},
+	}, nil
+}
+
+func changeReaction(user *User, roomID, messageID string, input ReactionInput, added bool) (*ReactionPayload, error) {
+	emoji := strings.TrimSpace(input.Emoji)
+	if !validReaction(emoji) {
+		return nil, ErrInvalidReaction
+	}
+
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	filter, err := reactionMessageFilter(room.ID, messageID)
+	if err != nil {
+		return nil, err
+	}
+
+	var update bson.M
+	if added {
+		// the same user can't react twice with the same emoji
+		filter["reactions"] = bson.M{"$not": bson.M{"$elemMatch": bson.M{
+			"emoji":  emoji,
+			"userId": user.ID,
+		}}}
+		update = bson.M{"$push": bson.M{"reactions": MessageReaction{
+			Emoji:     emoji,
+			UserID:    user.ID,
+			CreatedAt: time.Now(),
+		}}}
+	} else {
+		filter["reactions"] = bson.M{"$elemMatch": bson.M{
+			"emoji":  emoji,
+			"userId": user.ID,
+		}}
+		update = bson.M{"$pull": bson.M{"reactions": bson.M{
+			"emoji":  emoji,
+			"userId": user.ID,
+		}}}
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	err = MongoDatabase.Collection(messages).FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		// nothing to change when the reaction is already there, or already
+		// gone, as long as the message itself exists
+		delete(filter, "reactions")
+		err = MongoDatabase.Collection(messages).FindOne(context.Background(), filter).Decode(&message)
+		if err == mongo.ErrNoDocuments {
+			return nil, ErrMessageNotFound
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[changeReaction] %v", err)
+		}
+
+		return newReactionPayload(&message, user, emoji), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[changeReaction] %v", err)
+	}
+
+	eventType := ReactionAdded
+	if !added {
+		eventType = ReactionRemoved
+	}
+
+	payload := newReactionPayload(&message, user, emoji)
+	broadcast := *payload
+	broadcast.Reactions = SummarizeReactions(message.Reactions, nil)
+	SendEvent(roomID, room.ParticipantIDs(), NewEvent(eventType, broadcast))
+
+	return payload, nil
+}
+
+func newReactionPayload(message *Message, user *User, emoji string) *ReactionPayload {
+	return &ReactionPayload{
+		RoomID:    message.RoomID.Hex(),
+		MessageID: message.ID.Hex(),
+		UserID:    user.ID.Hex(),
+		Emoji:     emoji,
+		Reactions: SummarizeReactions(message.Reactions, &user.ID),
+	}
+}
+
+// AddReaction reacts to the message with the emoji, reacting twice with the
+// same emoji doesn't change anything.
+func AddReaction(user *User, roomID, messageID string, input ReactionInput) (*ReactionPayload, error) {
+	return changeReaction(user, roomID, messageID, input, true)
+}
+
+func RemoveReaction(user *User, roomID, messageID string, input ReactionInput) (*ReactionPayload, error) {
+	return changeReaction(user, roomID, messageID, input, false)
+}
+
+func reactionErrorStatus(err error) int {
+	if err == ErrInvalidReaction {
+		return 400
+	}
+
+	return messageErrorStatus(err)
+}
+
+func (f *MessageFunc) AddReactionHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[AddReactionHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to add reaction",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := ReactionInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[AddReactionHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to add reaction, please check your request data",
+		})
+		return
+	}
+
+	reaction, err := f.AddReactionFunc(user, ctx.Param("room_id"), ctx.Param("message_id"), input)
+	if err != nil {
+		log.Printf("[AddReactionHandler] %v", err)
+		ctx.JSON(reactionErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to add reaction",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully add reaction",
+		"data":    reaction,
+	})
+}
+
+func (f *MessageFunc) RemoveReactionHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[RemoveReactionHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to remove reaction",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := ReactionInput{Emoji: ctx.Param("emoji")}
+	reaction, err := f.RemoveReactionFunc(user, ctx.Param("room_id"), ctx.Param("message_id"), input)
+	if err != nil {
+		log.Printf("[RemoveReactionHandler] %v", err)
+		ctx.JSON(reactionErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to remove reaction",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully remove reaction",
+		"data":    reaction,
+	})
+}
@@ -0,0 +1,394 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	MarkRoomReadInput struct {
+		MessageID string `json:"messageId"`
+	}
+
+	MessageStatus string
+
+	MessageReceipt struct {
+		UserID      primitive.ObjectID `bson:"userId" json:"userId"`
+		DeliveredAt *time.Time         `bson:"deliveredAt,omitempty" json:"deliveredAt,omitempty"`
+		ReadAt      *time.Time         `bson:"readAt,omitempty" json:"readAt,omitempty"`
+	}
+
+	MessageStatusPayload struct {
+		RoomID     string        `json:"roomId"`
+		MessageIDs []string      `json:"messageIds"`
+		UserID     string        `json:"userId"`
+		Status     MessageStatus `json:"status"`
+		At         time.Time     `json:"at"`
+	}
+
+	ReadMarker struct {
+		RoomID            string              `json:"roomId"`
+		UserID            string              `json:"userId"`
+		LastReadMessageID *primitive.ObjectID `json:"lastReadMessageId"`
+		LastReadAt        *time.Time          `json:"lastReadAt"`
+	}
+)
+
+const (
+	Sent      MessageStatus = "sent"
+	Delivered MessageStatus = "delivered"
+	Read      MessageStatus = "read"
+)
+
+// NewMessageReceipts prepares an empty receipt for every participant other
+// than the sender.
+func NewMessageReceipts(room *Room, senderID primitive.ObjectID) []MessageReceipt {
+	receipts := make([]MessageReceipt, 0, len(room.Participants))
+	for _, participant := range room.Participants {
+		if participant.ID != senderID {
+			receipts = append(receipts, MessageReceipt{UserID: participant.ID})
+		}
+	}
+
+	return receipts
+}
+
+// DeliveryStatus summarizes the receipts, a message only counts as delivered
+// or read once every recipient reached that state.
+func (m *Message) DeliveryStatus() MessageStatus {
+	if len(m.Receipts) == 0 {
+		return Sent
+	}
+
+	status := Read
+	for _, receipt := range m.Receipts {
+		if receipt.DeliveredAt == nil && receipt.ReadAt == nil {
+			return Sent
+		}
+		if receipt.ReadAt == nil {
+			status = Delivered
+		}
+	}
+
+	return status
+}
+
+// MarkMessageDelivered records that the message reached a session of the
+// recipient and tells the sender, repeated deliveries are ignored.
+func MarkMessageDelivered(messageID, userID string) {
+	msgObjID, err := primitive.ObjectIDFromHex(messageID)
+	if err != nil {
+		log.Printf("[MarkMessageDelivered] %v", err)
+		return
+	}
+
+	userObjID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		log.Printf("[MarkMessageDelivered] %v", err)
+		return
+	}
+
+	now := time.Now()
+	filter := bson.M{
+		"_id": msgObjID,
+		"receipts": bson.M{"$elemMatch": bson.M{
+			"userId":      userObjID,
+			"deliveredAt": bson.M{"$exists": false},
+		}},
+	}
+	update := bson.M{
+		"$set": bson.M{"receipts.$.deliveredAt": now},
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var message Message
+	err = MongoDatabase.Collection(messages).FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&message)
+	if err == mongo.ErrNoDocuments {
+		return
+	}
+	if err != nil {
+		log.Printf("[MarkMessageDelivered] %v", err)
+		return
+	}
+
+	roomID := message.RoomID.Hex()
+	SendEvent(roomID, []string{message.UserID.Hex()}, NewEvent(MessageStatusChanged, MessageStatusPayload{
+		RoomID:     roomID,
+		MessageIDs: []string{messageID},
+		UserID:     userID,
+		Status:     Delivered,
+		At:         now,
+	}))
+}
+
+// markMessagesRead sets the read receipt of the user on every message up to
+// the read position, then tells each sender which of their messages were read.
+func markMessagesRead(roomID, userID primitive.ObjectID, lastReadAt time.Time) error {
+	filter := bson.M{
+		"roomId":    roomID,
+		"createdAt": bson.M{"$lte": lastReadAt},
+		"receipts": bson.M{"$elemMatch": bson.M{
+			"userId": userID,
+			"readAt": bson.M{"$exists": false},
+		}},
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1, "userId": 1})
+
+	cursor, err := MongoDatabase.Collection(messages).Find(context.Background(), filter, opts)
+	if err != nil {
+		return fmt.Errorf("[markMessagesRead] %v", err)
+	}
+
+	var unread []Message
+	if err := cursor.All(context.Background(), &unread); err != nil {
+		return fmt.Errorf("[markMessagesRead] %v", err)
+	}
+
+	if len(unread) == 0 {
+		return nil
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(unread))
+	bySender := make(map[string][]string)
+	for _, message := range unread {
+		ids = append(ids, message.ID)
+		senderID := message.UserID.Hex()
+		bySender[senderID] = append(bySender[senderID], message.ID.Hex())
+	}
+
+	now := time.Now()
+	for _, field := range []string{"deliveredAt", "readAt"} {
+		update := bson.M{
+			"$set": bson.M{"receipts.$[r]." + field: now},
+		}
+		updateOpts := options.Update().SetArrayFilters(options.ArrayFilters{
+			Filters: []interface{}{
+				bson.M{"r.userId": userID, "r." + field: bson.M{"$exists": false}},
+			},
+		})
+
+		_, err := MongoDatabase.Collection(messages).UpdateMany(context.Background(), bson.M{"_id": bson.M{"$in": ids}}, update, updateOpts)
+		if err != nil {
+			return fmt.Errorf("[markMessagesRead] %v", err)
+		}
+	}
+
+	for senderID, messageIDs := range bySender {
+		SendEvent(roomID.Hex(), []string{senderID}, NewEvent(MessageStatusChanged, MessageStatusPayload{
+			RoomID:     roomID.Hex(),
+			MessageIDs: messageIDs,
+			UserID:     userID.Hex(),
+			Status:     Read,
+			At:         now,
+		}))
+	}
+
+	return nil
+}
+
+// MarkRoomAsRead moves the read marker of the user forward to the message, or
+// to the newest message of the room when no message is given. The marker never
+// moves backwards, marking an older message keeps the current position.
+func MarkRoomAsRead(user *User, roomID string, input MarkRoomReadInput) (*ReadMarker, error) {
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var message *Message
+	if input.MessageID != "" {
+		message, err = FindMessageByID(input.MessageID)
+		if err != nil || message.RoomID != room.ID {
+			return nil, ErrMessageNotFound
+		}
+	} else {
+		message, err = FindLatestMessageInRoom(room.ID)
+		if err == mongo.ErrNoDocuments {
+			return readMarkerOf(room, user.ID), nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("[MarkRoomAsRead] %v", err)
+		}
+	}
+
+	filter := bson.M{
+		"_id": room.ID,
+		"participants": bson.M{"$elemMatch": bson.M{
+			"id": user.ID,
+			"$or": bson.A{
+				bson.M{"lastReadAt": bson.M{"$exists": false}},
+				bson.M{"lastReadAt": bson.M{"$lt": message.CreatedAt}},
+			},
+		}},
+	}
+	update := bson.M{
+		"$set": bson.M{
+			"participants.$.lastReadMessageId": message.ID,
+			"participants.$.lastReadAt":        message.CreatedAt,
+		},
+	}
+
+	res, err := MongoDatabase.Collection(rooms).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return nil, fmt.Errorf("[MarkRoomAsRead] %v", err)
+	}
+
+	room, err = FindRoomByID(roomID)
+	if err != nil {
+		return nil, fmt.Errorf("[MarkRoomAsRead] %v", err)
+	}
+
+	marker := readMarkerOf(room, user.ID)
+	if res.ModifiedCount > 0 {
+		// keep the unread badge in sync on the other sessions of the user
+		SendEvent(roomID, []string{user.ID.Hex()}, NewEvent(RoomRead, marker))
+
+		if err := markMessagesRead(room.ID, user.ID, message.CreatedAt); err != nil {
+			log.Printf("[MarkRoomAsRead] %v", err)
+		}
+	}
+
+	return marker, nil
+}
+
+func readMarkerOf(room *Room, userID primitive.ObjectID) *ReadMarker {
+	marker := &ReadMarker{
+		RoomID: room.ID.Hex(),
+		UserID: userID.Hex(),
+	}
+
+	if participant := room.FindParticipant(userID); participant != nil {
+		marker.LastReadMessageID = participant.LastReadMessageID
+		marker.LastReadAt = participant.LastReadAt
+	}
+
+	return marker
+}
+
+// CountUnreadMessages counts, in a single query, the messages other
+// participants sent in each room after the read position of the user. Rooms
+// mapped to nil were never read, every message in them counts.
+func CountUnreadMessages(userID primitive.ObjectID, lastReadAt map[primitive.ObjectID]*time.Time) (map[primitive.ObjectID]int64, error) {
+	counts := make(map[primitive.ObjectID]int64, len(lastReadAt))
+	if len(lastReadAt) == 0 {
+		return counts, nil
+	}
+
+	positions := make(bson.A, 0, len(lastReadAt))
+	for roomID, readAt := range lastReadAt {
+		position := bson.M{"roomId": roomID}
+		if readAt != nil {
+			position["createdAt"] = bson.M{"$gt": readAt}
+		}
+		positions = append(positions, position)
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", bson.D{
+			{"userId", bson.D{{"$ne", userID}}},
+			{"deletedAt", bson.D{{"$exists", false}}},
+			{"$or", positions},
+		}}},
+		bson.D{{"$group", bson.D{
+			{"_id", "$roomId"},
+			{"count", bson.D{{"$sum", 1}}},
+		}}},
+	}
+
+	cursor, err := MongoDatabase.Collection(messages).Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return nil, fmt.Errorf("[CountUnreadMessages] %v", err)
+	}
+
+	var result []struct {
+		RoomID primitive.ObjectID `bson:"_id"`
+		Count  int64              `bson:"count"`
+	}
+	if err := cursor.All(context.Background(), &result); err != nil {
+		return nil, fmt.Errorf("[CountUnreadMessages] %v", err)
+	}
+
+	for _, r := range result {
+		counts[r.RoomID] = r.Count
+	}
+
+	return counts, nil
+}
+
+// fillReadState sets the unread count and read position of the user on each
+// room of the list.
+func fillReadState(rooms []Room, userID primitive.ObjectID) error {
+	lastReadAt := make(map[primitive.ObjectID]*time.Time, len(rooms))
+	for i := range rooms {
+		if participant := rooms[i].FindParticipant(userID); participant != nil {
+			lastReadAt[rooms[i].ID] = participant.LastReadAt
+		}
+	}
+
+	counts, err := CountUnreadMessages(userID, lastReadAt)
+	if err != nil {
+		return err
+	}
+
+	for i := range rooms {
+		room := &rooms[i]
+		participant := room.FindParticipant(userID)
+		if participant == nil {
+			continue
+		}
+
+		room.UnreadCount = counts[room.ID]
+		room.LastReadMessageID = participant.LastReadMessageID
+	}
+
+	return nil
+}
+
+func (f *RoomFunc) MarkRoomReadHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[MarkRoomReadHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to mark room as read",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := MarkRoomReadInput{}
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBind(&input); err != nil {
+			log.Printf("[MarkRoomReadHandler] %v", err)
+			ctx.JSON(400, gin.H{
+				"status":  "error",
+				"message": "Failed to mark room as read, please check your request data",
+			})
+			return
+		}
+	}
+
+	marker, err := f.MarkRoomReadFunc(user, ctx.Param("room_id"), input)
+	if err != nil {
+		log.Printf("[MarkRoomReadHandler] %v", err)
+		ctx.JSON(messageErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to mark room as read",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully mark room as read",
+		"data":    marker,
+	})
+}
@@ -0,0 +1,217 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type (
+	// hubRevocation tells every api instance to close the websockets opened
+	// with a token that is not valid anymore. Only the set fields are matched.
+	hubRevocation struct {
+		UserID    string `json:"userId"`
+		TokenID   string `json:"tokenId,omitempty"`
+		SessionID string `json:"sessionId,omitempty"`
+		// tokens issued before this unix time in microseconds
+		Before int64 `json:"before,omitempty"`
+	}
+)
+
+func init() {
+	// issue times need sub-second precision, otherwise a token signed in the
+	// same second as a revocation can't be told apart from the revoked ones
+	jwt.TimePrecision = time.Microsecond
+}
+
+func revokedTokenKey(tokenID string) string {
+	return fmt.Sprintf("revoked_token:%s", tokenID)
+}
+
+func revokedSessionKey(sessionID string) string {
+	return fmt.Sprintf("revoked_session:%s", sessionID)
+}
+
+func revokedBeforeKey(userID string) string {
+	return fmt.Sprintf("revoked_before:%s", userID)
+}
+
+// IsTokenRevoked checks the token against the revocation list. Entries only
+// live as long as the tokens they revoke could, so the list stays small.
+func IsTokenRevoked(claims *AuthClaims) (bool, error) {
+	values, err := RedisClient.MGet(context.Background(),
+		revokedTokenKey(claims.RegisteredClaims.ID),
+		revokedSessionKey(claims.SessionID),
+		revokedBeforeKey(claims.ID),
+	).Result()
+	if err != nil {
+		return false, fmt.Errorf("[IsTokenRevoked] %v", err)
+	}
+
+	if values[0] != nil || values[1] != nil {
+		return true, nil
+	}
+
+	if before, ok := values[2].(string); ok {
+		micro, err := strconv.ParseInt(before, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("[IsTokenRevoked] %v", err)
+		}
+		if claims.IssuedAt == nil || claims.IssuedAt.UnixMicro() < micro {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// RevokeToken stops a single access token from being accepted.
+func RevokeToken(claims *AuthClaims) error {
+	exp := AuthTokenExpDuration
+	if claims.ExpiresAt != nil {
+		exp = time.Until(claims.ExpiresAt.Time)
+	}
+	if exp <= 0 {
+		return nil
+	}
+
+	if err := RedisClient.Set(context.Background(), revokedTokenKey(claims.RegisteredClaims.ID), 1, exp).Err(); err != nil {
+		return fmt.Errorf("[RevokeToken] %v", err)
+	}
+
+	wsHub.PublishRevocation(hubRevocation{
+		UserID:  claims.ID,
+		TokenID: claims.RegisteredClaims.ID,
+	})
+
+	return nil
+}
+
+// revokeSessionTokens stops every access token issued for the session.
+func revokeSessionTokens(userID, sessionID string) error {
+	if err := RedisClient.Set(context.Background(), revokedSessionKey(sessionID), 1, AuthTokenExpDuration).Err(); err != nil {
+		return fmt.Errorf("[revokeSessionTokens] %v", err)
+	}
+
+	wsHub.PublishRevocation(hubRevocation{
+		UserID:    userID,
+		SessionID: sessionID,
+	})
+
+	return nil
+}
+
+// RevokeUserTokens stops every access token of the user issued until now and
+// ends all of the user's sessions.
+func RevokeUserTokens(userID string) error {
+	objID, err := primitive.ObjectIDFromHex(userID)
+	if err != nil {
+		return fmt.Errorf("[RevokeUserTokens] %v", err)
+	}
+
+	now := time.Now()
+	if err := RedisClient.Set(context.Background(), revokedBeforeKey(userID), now.UnixMicro(), AuthTokenExpDuration).Err(); err != nil {
+		return fmt.Errorf("[RevokeUserTokens] %v", err)
+	}
+
+	filter := bson.M{
+		"userId":    objID,
+		"revokedAt": bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$set": bson.M{"revokedAt": now},
+	}
+	if _, err := MongoDatabase.Collection(sessions).UpdateMany(context.Background(), filter, update); err != nil {
+		return fmt.Errorf("[RevokeUserTokens] %v", err)
+	}
+
+	wsHub.PublishRevocation(hubRevocation{
+		UserID: userID,
+		Before: now.UnixMicro(),
+	})
+
+	return nil
+}
+
+// Logout revokes the token of the request and ends its session, or every
+// session of the user when everywhere is set.
+func Logout(claims *AuthClaims, everywhere bool) error {
+	if everywhere {
+		return RevokeUserTokens(claims.ID)
+	}
+
+	if err := RevokeToken(claims); err != nil {
+		return err
+	}
+
+	sessionID, err := primitive.ObjectIDFromHex(claims.SessionID)
+	if err != nil {
+		return nil
+	}
+
+	userID, err := primitive.ObjectIDFromHex(claims.ID)
+	if err != nil {
+		return nil
+	}
+
+	if err := RevokeSession(userID, sessionID); err != nil && err != ErrSessionNotFound {
+		return err
+	}
+
+	return nil
+}
+
+// PublishRevocation asks every instance to close the websockets of the
+// revoked tokens.
+func (h *Hub) PublishRevocation(rev hubRevocation) {
+	h.dispatch(usersChannel(), hubMessage{Revocation: &rev})
+}
+
+// closeRevoked closes the local websockets opened with a revoked token.
+func (h *Hub) closeRevoked(rev hubRevocation) {
+	for _, c := range h.Sessions(rev.UserID) {
+		switch {
+		case rev.TokenID != "" && c.TokenID == rev.TokenID,
+			rev.SessionID != "" && c.SessionID == rev.SessionID,
+			rev.Before != 0 && c.IssuedAt.UnixMicro() < rev.Before:
+			log.Printf("[Hub.closeRevoked] closing session %s of user %s", c.ID, c.UserID)
+			c.CloseWithReason(websocket.ClosePolicyViolation, "token revoked")
+		}
+	}
+}
+
+func (f *UserFunc) LogoutHandler(ctx *gin.Context) {
+	claimsCtx, ok := ctx.Get("claims")
+	if !ok {
+		log.Println("[LogoutHandler] Unable to get current token")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to logout",
+		})
+		return
+	}
+	claims := claimsCtx.(*AuthClaims)
+
+	everywhere := ctx.Query("everywhere") == "true"
+	if err := f.LogoutFunc(claims, everywhere); err != nil {
+		log.Printf("[LogoutHandler] %v", err)
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to logout",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully logout",
+	})
+}
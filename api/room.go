@@ -4,14 +4,22 @@ import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"path"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
 )
 
 type (
@@ -19,6 +27,24 @@ type (
 		Cursor string
 		Limit  int64
 		User   *User
+		Filter RoomFilter
+	}
+
+	// RoomFilter narrows the rooms of the user down by the preferences the
+	// user set on them, a nil field doesn't filter anything.
+	RoomFilter struct {
+		Archived ArchivedFilter
+		Muted    *bool
+		Favorite *bool
+	}
+
+	ArchivedFilter string
+
+	RoomCursor struct {
+		ID        string    `json:"id"`
+		UpdatedAt time.Time `json:"updatedAt"`
+		Favorite  bool      `json:"favorite,omitempty"`
+		Position  int       `json:"position,omitempty"`
 	}
 
 	GetRoomsOutput struct {
@@ -27,8 +53,36 @@ type (
 		Rooms  []Room
 	}
 
+	CreateRoomInput struct {
+		RoomType       RoomType `json:"roomType"`
+		UserID         string   `json:"userId"`
+		Name           string   `json:"name"`
+		ParticipantIDs []string `json:"participantIds"`
+	}
+
+	CreateRoomOutput struct {
+		Room    *Room
+		Created bool
+	}
+
 	RoomType string
 
+	AttachmentType string
+
+	// RoomLastMessage is the snapshot of the newest message shown in the room
+	// list, it carries enough to render the preview without the message.
+	RoomLastMessage struct {
+		ID             primitive.ObjectID `bson:"id,omitempty" json:"id,omitempty"`
+		Body           string             `bson:"body" json:"body"`
+		AttachmentType AttachmentType     `bson:"attachmentType,omitempty" json:"attachmentType,omitempty"`
+		SenderID       primitive.ObjectID `bson:"senderId,omitempty" json:"senderId,omitempty"`
+		SenderName     string             `bson:"senderName,omitempty" json:"senderName,omitempty"`
+		CreatedAt      time.Time          `bson:"createdAt,omitempty" json:"createdAt"`
+		EditedAt       *time.Time         `bson:"editedAt,omitempty" json:"editedAt,omitempty"`
+	}
+
+	ParticipantRole string
+
 	Participant struct {
 		ID        primitive.ObjectID `bson:"id,omitempty" json:"id"`
 		FirstName string             `bson:"firstName" json:"firstName"`
@@ -36,20 +90,61 @@ type (
 		Username  string             `bson:"username" json:"username"`
 		Email     string             `bson:"email" json:"email"`
 		Avatar    string             `bson:"avatar" json:"avatar"`
+		Role      ParticipantRole    `bson:"role,omitempty" json:"role,omitempty"`
+
+		LastReadMessageID *primitive.ObjectID `bson:"lastReadMessageId,omitempty" json:"lastReadMessageId,omitempty"`
+		LastReadAt        *time.Time          `bson:"lastReadAt,omitempty" json:"lastReadAt,omitempty"`
+
+		// preferences of the participant, only shown to the participant
+		// through the room fields below
+		Archived   bool       `bson:"archived,omitempty" json:"-"`
+		MutedUntil *time.Time `bson:"mutedUntil,omitempty" json:"-"`
+		Favorite   bool       `bson:"favorite,omitempty" json:"-"`
+		Position   int        `bson:"position,omitempty" json:"-"`
+
+		// filled when listing rooms
+		Presence *Presence `bson:"-" json:"presence,omitempty"`
 	}
 
 	Room struct {
-		ID           primitive.ObjectID `bson:"_id,omitempty" json:"id"`
-		Participants []Participant      `bson:"participants" json:"participants"`
-		RoomType     RoomType           `bson:"roomType" json:"roomType"`
-		LastMessage  string             `bson:"lastMessage" json:"lastMessage"`
-		CreatedAt    *time.Time         `bson:"createdAt,omitempty" json:"createdAt"`
-		UpdatedAt    *time.Time         `bson:"updatedAt,omitempty" json:"updatedAt"`
-		DeletedAt    *time.Time         `bson:"deletedAt,omitempty" json:"-"`
+		ID             primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+		Participants   []Participant      `bson:"participants" json:"participants"`
+		RoomType       RoomType           `bson:"roomType" json:"roomType"`
+		Name           string             `bson:"name,omitempty" json:"name,omitempty"`
+		LastMessage    *RoomLastMessage   `bson:"lastMessage,omitempty" json:"lastMessage"`
+		PinnedMessages []PinnedMessage    `bson:"pinnedMessages,omitempty" json:"pinnedMessages"`
+		PrivateKey     string             `bson:"privateKey,omitempty" json:"-"`
+		CreatedAt      *time.Time         `bson:"createdAt,omitempty" json:"createdAt"`
+		UpdatedAt      *time.Time         `bson:"updatedAt,omitempty" json:"updatedAt"`
+		DeletedAt      *time.Time         `bson:"deletedAt,omitempty" json:"-"`
+
+		// read state of the requesting user, filled when listing rooms
+		UnreadCount       int64               `bson:"-" json:"unreadCount"`
+		LastReadMessageID *primitive.ObjectID `bson:"-" json:"lastReadMessageId"`
+
+		// preferences of the requesting user
+		Archived   bool       `bson:"-" json:"archived"`
+		Muted      bool       `bson:"-" json:"muted"`
+		MutedUntil *time.Time `bson:"-" json:"mutedUntil"`
+		Favorite   bool       `bson:"-" json:"favorite"`
+		Position   int        `bson:"-" json:"position"`
 	}
 
 	RoomFunc struct {
-		GetRoomsFunc func(GetRoomsInput) GetRoomsOutput
+		GetRoomsFunc              func(GetRoomsInput) GetRoomsOutput
+		CreateRoomFunc            func(*User, CreateRoomInput) (CreateRoomOutput, error)
+		UpdateRoomFunc            func(*User, string, UpdateRoomInput) (*Room, error)
+		AddParticipantsFunc       func(*User, string, AddParticipantsInput) (*Room, error)
+		RemoveParticipantFunc     func(*User, string, string) (*Room, error)
+		UpdateParticipantRoleFunc func(*User, string, string, UpdateParticipantRoleInput) (*Room, error)
+		TransferOwnershipFunc     func(*User, string, TransferOwnershipInput) (*Room, error)
+		LeaveRoomFunc             func(*User, string) error
+		MarkRoomReadFunc          func(*User, string, MarkRoomReadInput) (*ReadMarker, error)
+		GetRoomFunc               func(*User, string) (*Room, error)
+		PinMessageFunc            func(*User, string, string) (*PinnedMessage, error)
+		UnpinMessageFunc          func(*User, string, string) error
+		GetPinnedMessagesFunc     func(*User, string) ([]PinnedMessage, error)
+		UpdatePreferencesFunc     func(*User, string, UpdateRoomPreferencesInput) (*RoomPreferences, error)
 	}
 )
 
@@ -57,9 +152,107 @@ const (
 	Private RoomType = "private"
 	Group   RoomType = "group"
 
+	ArchivedExcluded ArchivedFilter = "false"
+	ArchivedOnly     ArchivedFilter = "true"
+	ArchivedAll      ArchivedFilter = "all"
+
+	ImageAttachment AttachmentType = "image"
+	VideoAttachment AttachmentType = "video"
+	AudioAttachment AttachmentType = "audio"
+	FileAttachment  AttachmentType = "file"
+
+	Owner  ParticipantRole = "owner"
+	Admin  ParticipantRole = "admin"
+	Member ParticipantRole = "member"
+
 	rooms string = "rooms"
 )
 
+var (
+	ErrRoomWithSelf        = errors.New("unable to create a private room with yourself")
+	ErrRoomTargetRequired  = errors.New("user id is required to create a private room")
+	ErrInvalidRoomType     = errors.New("room type should be private or group")
+	ErrNotRoomParticipant  = errors.New("user is not a participant of the room")
+	ErrRoomPermission      = errors.New("user doesn't have permission to manage the room")
+	ErrNotGroupRoom        = errors.New("room is not a group room")
+	ErrGroupNameRequired   = errors.New("group name is required")
+	ErrInvalidRole         = errors.New("role should be admin or member")
+	ErrParticipantNotFound = errors.New("participant not found in the room")
+)
+
+func CreateRoomIndexes() error {
+	indexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{"privateKey", 1}},
+			Options: options.Index().
+				SetUnique(true).
+				SetPartialFilterExpression(bson.M{"privateKey": bson.M{"$exists": true}}),
+		},
+		{
+			Keys: bson.D{{"participants.id", 1}, {"updatedAt", -1}},
+		},
+	}
+
+	_, err := MongoDatabase.Collection(rooms).Indexes().CreateMany(context.Background(), indexes)
+	if err != nil {
+		return fmt.Errorf("[CreateRoomIndexes] %v", err)
+	}
+
+	return nil
+}
+
+func NewParticipant(user *User) Participant {
+	participant := Participant{
+		ID:        user.ID,
+		FirstName: user.FirstName,
+		Username:  user.Username,
+		Email:     user.Email,
+	}
+	if user.LastName != nil {
+		participant.LastName = *user.LastName
+	}
+	if user.Avatar != nil {
+		participant.Avatar = *user.Avatar
+	}
+
+	return participant
+}
+
+// FindParticipant returns the participant entry of the user, or nil when the
+// user is not a member of the room.
+func (r *Room) FindParticipant(userID primitive.ObjectID) *Participant {
+	for i := range r.Participants {
+		if r.Participants[i].ID == userID {
+			return &r.Participants[i]
+		}
+	}
+
+	return nil
+}
+
+func (r *Room) ParticipantIDs() []string {
+	ids := make([]string, 0, len(r.Participants))
+	for _, participant := range r.Participants {
+		ids = append(ids, participant.ID.Hex())
+	}
+
+	return ids
+}
+
+// CanManageMembers reports whether the participant may change the group
+// membership, rooms created before roles existed treat everyone as member.
+func (p *Participant) CanManageMembers() bool {
+	return p.Role == Owner || p.Role == Admin
+}
+
+// privateRoomKey builds an order independent key for a pair of users, so the
+// same two users always resolve to the same private room.
+func privateRoomKey(a, b primitive.ObjectID) string {
+	ids := []string{a.Hex(), b.Hex()}
+	sort.Strings(ids)
+	return strings.Join(ids, ":")
+}
+
 func (r *Room) Save() error {
 	now := time.Now()
 	if r.CreatedAt == nil {
@@ -88,15 +281,135 @@ func (r *Room) Save() error {
 	return nil
 }
 
-func SaveLastMessageInRoom(id, lastMessage string) error {
-	room, err := FindRoomByID(id)
-	if err != nil {
-		return err
+// NewRoomLastMessage takes the snapshot of the message shown in the room list.
+func NewRoomLastMessage(message *Message, sender *User) *RoomLastMessage {
+	body := []rune(strings.TrimSpace(message.Body))
+	if len(body) > previewLength {
+		body = append(body[:previewLength], '…')
+	}
+
+	snapshot := &RoomLastMessage{
+		ID:        message.ID,
+		Body:      string(body),
+		SenderID:  message.UserID,
+		CreatedAt: message.CreatedAt,
+		EditedAt:  message.EditedAt,
+	}
+
+	if message.Attachment != nil && *message.Attachment != "" {
+		snapshot.AttachmentType = attachmentType(*message.Attachment)
+	}
+
+	if sender != nil {
+		snapshot.SenderName = sender.FirstName
+		if snapshot.SenderName == "" {
+			snapshot.SenderName = sender.Username
+		}
+	}
+
+	return snapshot
+}
+
+// attachmentType guesses the kind of the attachment from its url, uploads go
+// through cloudinary which puts the resource type in the path.
+func attachmentType(attachment string) AttachmentType {
+	lower := strings.ToLower(attachment)
+	if i := strings.IndexAny(lower, "?#"); i != -1 {
+		lower = lower[:i]
+	}
+
+	switch {
+	case strings.Contains(lower, "/image/upload/"):
+		return ImageAttachment
+	case strings.Contains(lower, "/video/upload/"):
+		return VideoAttachment
 	}
 
-	room.LastMessage = lastMessage
-	if err := room.Save(); err != nil {
-		return err
+	switch strings.TrimPrefix(path.Ext(lower), ".") {
+	case "jpg", "jpeg", "png", "gif", "webp", "heic":
+		return ImageAttachment
+	case "mp4", "mov", "webm", "mkv":
+		return VideoAttachment
+	case "mp3", "wav", "ogg", "m4a", "aac":
+		return AudioAttachment
+	}
+
+	return FileAttachment
+}
+
+// UnmarshalBSONValue reads the snapshot, rooms written before it existed only
+// kept the body of the last message.
+func (m *RoomLastMessage) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	switch t {
+	case bsontype.Null:
+		*m = RoomLastMessage{}
+		return nil
+	case bsontype.String:
+		body, _, ok := bsoncore.ReadString(data)
+		if !ok {
+			return errors.New("invalid last message")
+		}
+		*m = RoomLastMessage{Body: body}
+		return nil
+	}
+
+	type snapshot RoomLastMessage
+	return bson.RawValue{Type: t, Value: data}.Unmarshal((*snapshot)(m))
+}
+
+// SaveLastMessageInRoom puts the message in the room preview unless the room
+// already shows a newer one. The check is part of the update, so concurrent
+// senders can't replace a newer message with an older one.
+func SaveLastMessageInRoom(message *Message, sender *User) error {
+	snapshot := NewRoomLastMessage(message, sender)
+
+	filter := bson.M{
+		"_id": message.RoomID,
+		"$or": bson.A{
+			bson.M{"lastMessage.createdAt": bson.M{"$exists": false}},
+			bson.M{"lastMessage.createdAt": bson.M{"$lt": snapshot.CreatedAt}},
+			bson.M{
+				"lastMessage.createdAt": snapshot.CreatedAt,
+				"lastMessage.id":        bson.M{"$lte": snapshot.ID},
+			},
+		},
+	}
+	update := bson.M{
+		"$set": bson.M{"lastMessage": snapshot},
+		"$max": bson.M{"updatedAt": snapshot.CreatedAt},
+	}
+	if _, err := MongoDatabase.Collection(rooms).UpdateOne(context.Background(), filter, update); err != nil {
+		return fmt.Errorf("[SaveLastMessageInRoom] %v", err)
+	}
+
+	return nil
+}
+
+// RefreshLastMessageInRoom rebuilds the room preview after the message was
+// edited or deleted, the preview only changes while it still shows that
+// message so a message sent in the meantime is kept.
+func RefreshLastMessageInRoom(roomID, messageID primitive.ObjectID) error {
+	filter := bson.M{
+		"_id":            roomID,
+		"lastMessage.id": messageID,
+	}
+
+	var update bson.M
+	message, err := FindLatestMessageInRoom(roomID)
+	if err == mongo.ErrNoDocuments {
+		update = bson.M{"$unset": bson.M{"lastMessage": ""}}
+	} else if err != nil {
+		return fmt.Errorf("[RefreshLastMessageInRoom] %v", err)
+	} else {
+		sender, err := FindUserByID(message.UserID.Hex())
+		if err != nil {
+			return fmt.Errorf("[RefreshLastMessageInRoom] %v", err)
+		}
+		update = bson.M{"$set": bson.M{"lastMessage": NewRoomLastMessage(message, sender)}}
+	}
+
+	if _, err := MongoDatabase.Collection(rooms).UpdateOne(context.Background(), filter, update); err != nil {
+		return fmt.Errorf("[RefreshLastMessageInRoom] %v", err)
 	}
 
 	return nil
@@ -120,40 +433,210 @@ func FindRoomByID(id string) (*Room, error) {
 	return &room, nil
 }
 
-func FindRoomsByUserID(userID *primitive.ObjectID, cursorObj map[string]interface{}, limit int64) ([]Room, error) {
-	pipeline := mongo.Pipeline{
-		bson.D{{"$sort", bson.D{{"updatedAt", -1}, {"_id", -1}}}},
+// FindRoomForParticipant loads the room only when the user is one of its
+// participants.
+func FindRoomForParticipant(roomID string, userID primitive.ObjectID) (*Room, error) {
+	room, err := FindRoomByID(roomID)
+	if err != nil {
+		return nil, err
+	}
+
+	if room.FindParticipant(userID) == nil {
+		return nil, ErrNotRoomParticipant
+	}
+
+	return room, nil
+}
+
+func FindPrivateRoomByKey(key string) (*Room, error) {
+	filter := bson.M{
+		"roomType":   Private,
+		"privateKey": key,
+	}
+
+	var room Room
+	if err := MongoDatabase.Collection(rooms).FindOne(context.Background(), filter).Decode(&room); err != nil {
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+// FindPrivateRoomByParticipants looks up a private room by its members, which
+// also covers rooms created before the private key was introduced.
+func FindPrivateRoomByParticipants(a, b primitive.ObjectID) (*Room, error) {
+	filter := bson.M{
+		"roomType":        Private,
+		"participants":    bson.M{"$size": 2},
+		"participants.id": bson.M{"$all": bson.A{a, b}},
+	}
+
+	var room Room
+	if err := MongoDatabase.Collection(rooms).FindOne(context.Background(), filter).Decode(&room); err != nil {
+		return nil, err
+	}
+
+	return &room, nil
+}
+
+// FindOrCreatePrivateRoom returns the private room between two users, creating
+// it with a single upsert when it does not exist yet.
+func FindOrCreatePrivateRoom(user, target *User) (*Room, bool, error) {
+	room, err := FindPrivateRoomByParticipants(user.ID, target.ID)
+	if err == nil {
+		return room, false, nil
+	}
+	if err != mongo.ErrNoDocuments {
+		return nil, false, fmt.Errorf("[FindOrCreatePrivateRoom] %v", err)
+	}
+
+	key := privateRoomKey(user.ID, target.ID)
+	now := time.Now()
+	filter := bson.M{
+		"roomType":   Private,
+		"privateKey": key,
+	}
+	update := bson.M{
+		"$setOnInsert": bson.M{
+			"participants": []Participant{NewParticipant(user), NewParticipant(target)},
+			"createdAt":    now,
+			"updatedAt":    now,
+		},
+	}
+
+	res, err := MongoDatabase.Collection(rooms).UpdateOne(context.Background(), filter, update, options.Update().SetUpsert(true))
+	// a concurrent request may win the upsert race, the unique index on
+	// privateKey rejects our insert and the room can be read back instead
+	if err != nil && !mongo.IsDuplicateKeyError(err) {
+		return nil, false, fmt.Errorf("[FindOrCreatePrivateRoom] %v", err)
+	}
+
+	room, err = FindPrivateRoomByKey(key)
+	if err != nil {
+		return nil, false, fmt.Errorf("[FindOrCreatePrivateRoom] %v", err)
+	}
+
+	created := res != nil && res.UpsertedCount > 0
+	return room, created, nil
+}
+
+// FindRoomIDsByUserID returns the id of every room the user participates in.
+func FindRoomIDsByUserID(userID primitive.ObjectID) ([]primitive.ObjectID, error) {
+	filter := bson.M{
+		"participants.id": userID,
+	}
+	opts := options.Find().SetProjection(bson.M{"_id": 1})
+
+	cursor, err := MongoDatabase.Collection(rooms).Find(context.Background(), filter, opts)
+	if err != nil {
+		return []primitive.ObjectID{}, fmt.Errorf("[FindRoomIDsByUserID] %v", err)
+	}
+
+	var result []Room
+	if err := cursor.All(context.Background(), &result); err != nil {
+		return []primitive.ObjectID{}, fmt.Errorf("[FindRoomIDsByUserID] %v", err)
+	}
+
+	ids := make([]primitive.ObjectID, 0, len(result))
+	for _, room := range result {
+		ids = append(ids, room.ID)
 	}
 
+	return ids, nil
+}
+
+// FindRoomsByUserID returns a page of the rooms of the user, favorites first
+// in the order the user gave them, then the most recently active rooms.
+func FindRoomsByUserID(userID *primitive.ObjectID, filter RoomFilter, cursorObj *RoomCursor, limit int64) ([]Room, error) {
+	pipeline := mongo.Pipeline{}
+
 	if userID != nil {
-		// it prepend to the pipline array
-		pipeline = append(mongo.Pipeline{
-			bson.D{{"$match", bson.D{{"participants", bson.D{{"$elemMatch", bson.D{{"id", userID}}}}}}}},
-		}, pipeline...)
+		pipeline = append(pipeline, bson.D{{"$match", bson.D{{"participants", bson.D{{"$elemMatch", bson.D{{"id", userID}}}}}}}})
 	}
 
-	if len(cursorObj) != 0 {
-		id := cursorObj["id"].(string)
-		updatedAt, err := time.Parse(time.RFC3339, cursorObj["updatedAt"].(string))
-		if err != nil {
-			return []Room{}, err
+	// the preferences of the user decide the order, so they are lifted out of
+	// the participant list before sorting
+	isFavorite := bson.D{{"$eq", bson.A{"$me.favorite", true}}}
+	pipeline = append(pipeline,
+		bson.D{{"$addFields", bson.D{
+			{"me", bson.D{{"$arrayElemAt", bson.A{
+				bson.D{{"$filter", bson.D{
+					{"input", "$participants"},
+					{"as", "p"},
+					{"cond", bson.D{{"$eq", bson.A{"$$p.id", userID}}}},
+				}}},
+				0,
+			}}}},
+		}}},
+		bson.D{{"$addFields", bson.D{
+			{"sortFavorite", bson.D{{"$cond", bson.A{isFavorite, 1, 0}}}},
+			{"sortPosition", bson.D{{"$cond", bson.A{isFavorite, bson.D{{"$ifNull", bson.A{"$me.position", 0}}}, 0}}}},
+		}}},
+	)
+
+	switch filter.Archived {
+	case ArchivedOnly:
+		pipeline = append(pipeline, bson.D{{"$match", bson.D{{"me.archived", true}}}})
+	case ArchivedAll:
+	default:
+		pipeline = append(pipeline, bson.D{{"$match", bson.D{{"me.archived", bson.D{{"$ne", true}}}}}})
+	}
+
+	if filter.Muted != nil {
+		now := time.Now()
+		if *filter.Muted {
+			pipeline = append(pipeline, bson.D{{"$match", bson.D{{"me.mutedUntil", bson.D{{"$gt", now}}}}}})
+		} else {
+			pipeline = append(pipeline, bson.D{{"$match", bson.D{{"me.mutedUntil", bson.D{{"$not", bson.D{{"$gt", now}}}}}}}})
 		}
+	}
+
+	if filter.Favorite != nil {
+		favorite := 0
+		if *filter.Favorite {
+			favorite = 1
+		}
+		pipeline = append(pipeline, bson.D{{"$match", bson.D{{"sortFavorite", favorite}}}})
+	}
 
-		roomObjID, err := primitive.ObjectIDFromHex(id)
-		timeObj := primitive.NewDateTimeFromTime(updatedAt)
+	pipeline = append(pipeline, bson.D{{"$sort", bson.D{
+		{"sortFavorite", -1},
+		{"sortPosition", 1},
+		{"updatedAt", -1},
+		{"_id", -1},
+	}}})
+
+	if cursorObj != nil {
+		roomObjID, err := primitive.ObjectIDFromHex(cursorObj.ID)
 		if err != nil {
 			return []Room{}, err
 		}
 
-		pipeline = append(pipeline, bson.D{
-			{
-				"$match",
-				bson.D{
-					{"updatedAt", bson.D{{"$gt", timeObj}}},
-					{"_id", bson.D{{"$gt", roomObjID}}},
-				},
+		favorite := 0
+		if cursorObj.Favorite {
+			favorite = 1
+		}
+		timeObj := primitive.NewDateTimeFromTime(cursorObj.UpdatedAt)
+
+		// rooms coming after the cursor in the sort order above
+		pipeline = append(pipeline, bson.D{{"$match", bson.D{{"$or", bson.A{
+			bson.D{{"sortFavorite", bson.D{{"$lt", favorite}}}},
+			bson.D{
+				{"sortFavorite", favorite},
+				{"sortPosition", bson.D{{"$gt", cursorObj.Position}}},
 			},
-		})
+			bson.D{
+				{"sortFavorite", favorite},
+				{"sortPosition", cursorObj.Position},
+				{"updatedAt", bson.D{{"$lt", timeObj}}},
+			},
+			bson.D{
+				{"sortFavorite", favorite},
+				{"sortPosition", cursorObj.Position},
+				{"updatedAt", timeObj},
+				{"_id", bson.D{{"$lt", roomObjID}}},
+			},
+		}}}}})
 	}
 
 	pipeline = append(pipeline,
@@ -206,12 +689,58 @@ func UpdateAvatarInParticipants(userID, avatarURL string) {
 
 func RoomDefaultHandler() *RoomFunc {
 	return &RoomFunc{
-		GetRoomsFunc: GetRooms,
+		GetRoomsFunc:              GetRooms,
+		CreateRoomFunc:            CreateRoom,
+		UpdateRoomFunc:            UpdateRoom,
+		AddParticipantsFunc:       AddParticipants,
+		RemoveParticipantFunc:     RemoveParticipant,
+		UpdateParticipantRoleFunc: UpdateParticipantRole,
+		TransferOwnershipFunc:     TransferOwnership,
+		LeaveRoomFunc:             LeaveRoom,
+		MarkRoomReadFunc:          MarkRoomAsRead,
+		GetRoomFunc:               GetRoom,
+		PinMessageFunc:            PinMessage,
+		UnpinMessageFunc:          UnpinMessage,
+		GetPinnedMessagesFunc:     GetPinnedMessages,
+		UpdatePreferencesFunc:     UpdateRoomPreferences,
+	}
+}
+
+func CreateRoom(user *User, input CreateRoomInput) (CreateRoomOutput, error) {
+	switch input.RoomType {
+	case Group:
+		return CreateGroupRoom(user, input)
+	case Private, "":
+	default:
+		return CreateRoomOutput{}, ErrInvalidRoomType
+	}
+
+	if input.UserID == "" {
+		return CreateRoomOutput{}, ErrRoomTargetRequired
+	}
+
+	if input.UserID == user.ID.Hex() {
+		return CreateRoomOutput{}, ErrRoomWithSelf
+	}
+
+	target, err := FindUserByID(input.UserID)
+	if err != nil {
+		return CreateRoomOutput{}, err
+	}
+
+	room, created, err := FindOrCreatePrivateRoom(user, target)
+	if err != nil {
+		return CreateRoomOutput{}, err
 	}
+
+	return CreateRoomOutput{
+		Room:    room,
+		Created: created,
+	}, nil
 }
 
 func GetRooms(input GetRoomsInput) GetRoomsOutput {
-	cursorInput := make(map[string]interface{})
+	var cursorInput *RoomCursor
 	if input.Cursor != "" {
 		decoded, err := base64.StdEncoding.DecodeString(input.Cursor)
 		if err != nil {
@@ -222,7 +751,8 @@ func GetRooms(input GetRoomsInput) GetRoomsOutput {
 			}
 		}
 
-		err = json.Unmarshal(decoded, &cursorInput)
+		cursorInput = &RoomCursor{}
+		err = json.Unmarshal(decoded, cursorInput)
 		if err != nil {
 			log.Printf("[GetRooms] %v", err)
 			return GetRoomsOutput{
@@ -237,7 +767,7 @@ func GetRooms(input GetRoomsInput) GetRoomsOutput {
 		userID = &input.User.ID
 	}
 
-	rooms, err := FindRoomsByUserID(userID, cursorInput, input.Limit)
+	rooms, err := FindRoomsByUserID(userID, input.Filter, cursorInput, input.Limit)
 	if err != nil {
 		log.Printf("[GetRooms] %v", err)
 		return GetRoomsOutput{
@@ -246,12 +776,29 @@ func GetRooms(input GetRoomsInput) GetRoomsOutput {
 		}
 	}
 
+	if userID != nil {
+		if err := fillReadState(rooms, *userID); err != nil {
+			log.Printf("[GetRooms] %v", err)
+		}
+		fillPreferences(rooms, *userID)
+	}
+
+	if err := fillPresence(rooms); err != nil {
+		log.Printf("[GetRooms] %v", err)
+	}
+
 	var cursor string
 	if len(rooms) != 0 {
 		lastRoom := rooms[len(rooms)-1]
-		c := map[string]interface{}{
-			"id":        lastRoom.ID.Hex(),
-			"updatedAt": lastRoom.UpdatedAt,
+		c := RoomCursor{
+			ID:       lastRoom.ID.Hex(),
+			Favorite: lastRoom.Favorite,
+		}
+		if lastRoom.UpdatedAt != nil {
+			c.UpdatedAt = *lastRoom.UpdatedAt
+		}
+		if lastRoom.Favorite {
+			c.Position = lastRoom.Position
 		}
 		jsonCursor, err := json.Marshal(c)
 		if err != nil {
@@ -274,6 +821,60 @@ func GetRooms(input GetRoomsInput) GetRoomsOutput {
 	return output
 }
 
+// GetRoom returns the room as the user sees it when opening it, with the read
+// state, the presence of the participants and the pinned messages.
+func GetRoom(user *User, roomID string) (*Room, error) {
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	rooms := []Room{*room}
+	if err := fillReadState(rooms, user.ID); err != nil {
+		log.Printf("[GetRoom] %v", err)
+	}
+	if err := fillPresence(rooms); err != nil {
+		log.Printf("[GetRoom] %v", err)
+	}
+	fillPreferences(rooms, user.ID)
+	room = &rooms[0]
+
+	if err := fillPinnedMessages(room); err != nil {
+		return nil, err
+	}
+
+	return room, nil
+}
+
+func (f *RoomFunc) GetRoomHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[GetRoomHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to get room",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	room, err := f.GetRoomFunc(user, ctx.Param("room_id"))
+	if err != nil {
+		log.Printf("[GetRoomHandler] %v", err)
+		ctx.JSON(roomErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to get room",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully get room",
+		"data":    room,
+	})
+}
+
 func (f *RoomFunc) GetRoomsHandler(ctx *gin.Context) {
 	cursor := ctx.Query("cursor")
 	limitQuery := ctx.Query("limit")
@@ -301,10 +902,21 @@ func (f *RoomFunc) GetRoomsHandler(ctx *gin.Context) {
 		}
 	}
 
+	filter, err := parseRoomFilter(ctx)
+	if err != nil {
+		log.Printf("[GetRoomsHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to get rooms, please check the filters",
+		})
+		return
+	}
+
 	input := GetRoomsInput{
 		Cursor: cursor,
 		Limit:  int64(limit),
 		User:   user,
+		Filter: filter,
 	}
 	output := f.GetRoomsFunc(input)
 
@@ -317,3 +929,71 @@ func (f *RoomFunc) GetRoomsHandler(ctx *gin.Context) {
 		"data": output.Rooms,
 	})
 }
+
+func (f *RoomFunc) CreateRoomHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[CreateRoomHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to create room",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := CreateRoomInput{}
+	if err := ctx.ShouldBind(&input); err != nil {
+		log.Printf("[CreateRoomHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to create room, please check your request data",
+		})
+		return
+	}
+
+	output, err := f.CreateRoomFunc(user, input)
+	if err != nil {
+		log.Printf("[CreateRoomHandler] %v", err)
+		if err == ErrRoomWithSelf {
+			ctx.JSON(422, gin.H{
+				"status":  "error",
+				"message": "Failed to create room, you can't start a conversation with yourself",
+			})
+			return
+		}
+
+		if err == ErrRoomTargetRequired || err == ErrInvalidRoomType || err == ErrGroupNameRequired {
+			ctx.JSON(400, gin.H{
+				"status":  "error",
+				"message": "Failed to create room, please check your request data",
+			})
+			return
+		}
+
+		if err == mongo.ErrNoDocuments || err == primitive.ErrInvalidHex {
+			ctx.JSON(404, gin.H{
+				"status":  "error",
+				"message": "Failed to create room, user not found",
+			})
+			return
+		}
+
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to create room",
+		})
+		return
+	}
+
+	statusCode := 200
+	if output.Created {
+		statusCode = 201
+	}
+
+	ctx.JSON(statusCode, gin.H{
+		"status":  "success",
+		"message": "Successfully open the room",
+		"data":    output.Room,
+	})
+}
@@ -0,0 +1,357 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	SearchMessagesInput struct {
+		Query         string     `form:"q"`
+		RoomID        string     `form:"roomId"`
+		SenderID      string     `form:"senderId"`
+		From          *time.Time `form:"from" time_format:"2006-01-02T15:04:05Z07:00"`
+		To            *time.Time `form:"to" time_format:"2006-01-02T15:04:05Z07:00"`
+		HasAttachment *bool      `form:"hasAttachment"`
+		Cursor        string     `form:"cursor"`
+		Limit         int64      `form:"limit"`
+	}
+
+	SearchMessagesOutput struct {
+		Cursor  string
+		Limit   int64
+		Results []MessageSearchResult
+	}
+
+	MessageSearchResult struct {
+		Message
+		Snippet string `json:"snippet"`
+	}
+)
+
+var (
+	ErrSearchQueryRequired = errors.New("search query is required")
+	ErrInvalidSearchSender = errors.New("sender filter should be a valid user id")
+)
+
+const (
+	// number of characters kept on each side of the first match in a snippet
+	snippetRadius = 60
+)
+
+// SearchMessages looks up the messages whose body matches the query in the
+// rooms the user participates in, newest first.
+func SearchMessages(user *User, input SearchMessagesInput) (SearchMessagesOutput, error) {
+	output := SearchMessagesOutput{
+		Limit:   input.Limit,
+		Results: []MessageSearchResult{},
+	}
+
+	query := strings.TrimSpace(input.Query)
+	if query == "" {
+		return output, ErrSearchQueryRequired
+	}
+
+	match := bson.D{
+		{"$text", bson.D{{"$search", query}}},
+		{"deletedAt", bson.D{{"$exists", false}}},
+	}
+
+	if input.RoomID != "" {
+		room, err := FindRoomForParticipant(input.RoomID, user.ID)
+		if err != nil {
+			return output, err
+		}
+		match = append(match, bson.E{"roomId", room.ID})
+	} else {
+		roomIDs, err := FindRoomIDsByUserID(user.ID)
+		if err != nil {
+			return output, err
+		}
+		match = append(match, bson.E{"roomId", bson.D{{"$in", roomIDs}}})
+	}
+
+	if input.SenderID != "" {
+		senderID, err := primitive.ObjectIDFromHex(input.SenderID)
+		if err != nil {
+			return output, ErrInvalidSearchSender
+		}
+		match = append(match, bson.E{"userId", senderID})
+	}
+
+	createdAt := bson.D{}
+	if input.From != nil {
+		createdAt = append(createdAt, bson.E{"$gte", input.From})
+	}
+	if input.To != nil {
+		createdAt = append(createdAt, bson.E{"$lte", input.To})
+	}
+	if len(createdAt) != 0 {
+		match = append(match, bson.E{"createdAt", createdAt})
+	}
+
+	if input.HasAttachment != nil {
+		if *input.HasAttachment {
+			match = append(match, bson.E{"attachment", bson.D{{"$nin", bson.A{nil, ""}}}})
+		} else {
+			match = append(match, bson.E{"attachment", bson.D{{"$in", bson.A{nil, ""}}}})
+		}
+	}
+
+	if input.Cursor != "" {
+		anchor, err := DecodeMessageCursor(input.Cursor)
+		if err != nil {
+			return output, err
+		}
+
+		msgObjID, err := primitive.ObjectIDFromHex(anchor.ID)
+		if err != nil {
+			return output, err
+		}
+		timeObj := primitive.NewDateTimeFromTime(anchor.CreatedAt)
+
+		match = append(match, bson.E{"$or", bson.A{
+			bson.D{{"createdAt", bson.D{{"$lt", timeObj}}}},
+			bson.D{
+				{"createdAt", timeObj},
+				{"_id", bson.D{{"$lt", msgObjID}}},
+			},
+		}})
+	}
+
+	pipeline := mongo.Pipeline{
+		bson.D{{"$match", match}},
+		bson.D{{"$sort", bson.D{{"createdAt", -1}, {"_id", -1}}}},
+		bson.D{{"$limit", input.Limit + 1}},
+		bson.D{
+			{"$lookup",
+				bson.D{
+					{"from", "users"},
+					{"localField", "userId"},
+					{"foreignField", "_id"},
+					{"as", "user"},
+				},
+			},
+		},
+		bson.D{{"$unwind", bson.D{{"path", "$user"}}}},
+		bson.D{
+			{"$lookup",
+				bson.D{
+					{"from", "rooms"},
+					{"localField", "roomId"},
+					{"foreignField", "_id"},
+					{"as", "room"},
+				},
+			},
+		},
+		bson.D{{"$unwind", bson.D{{"path", "$room"}}}},
+	}
+
+	cursor, err := MongoDatabase.Collection(messages).Aggregate(context.Background(), pipeline)
+	if err != nil {
+		return output, fmt.Errorf("[SearchMessages] %v", err)
+	}
+
+	var messages []Message
+	if err := cursor.All(context.Background(), &messages); err != nil {
+		return output, fmt.Errorf("[SearchMessages] %v", err)
+	}
+
+	hasMore := int64(len(messages)) > input.Limit
+	if hasMore {
+		messages = messages[:input.Limit]
+	}
+
+	terms := searchTerms(query)
+	for _, message := range messages {
+		message.Status = message.DeliveryStatus()
+		message.ReactionSummaries = SummarizeReactions(message.Reactions, &user.ID)
+		output.Results = append(output.Results, MessageSearchResult{
+			Message: message,
+			Snippet: highlightSnippet(message.Body, terms),
+		})
+	}
+
+	if hasMore && len(messages) != 0 {
+		output.Cursor, err = NewMessageCursor(messages[len(messages)-1]).Encode()
+		if err != nil {
+			return output, fmt.Errorf("[SearchMessages] %v", err)
+		}
+	}
+
+	return output, nil
+}
+
+// searchTerms returns the lowercased words of the query, leaving out the
+// negated ones since they can't appear in a result.
+func searchTerms(query string) []string {
+	terms := make([]string, 0)
+	for _, field := range strings.Fields(query) {
+		if strings.HasPrefix(field, "-") {
+			continue
+		}
+
+		term := strings.ToLower(strings.Trim(field, `"`))
+		if term != "" {
+			terms = append(terms, term)
+		}
+	}
+
+	return terms
+}
+
+// highlightSnippet cuts the part of the body around the first match and wraps
+// every word starting with one of the terms in a mark tag. The text search
+// matches on word stems, so a prefix is the closest we get to what matched.
+// The rest of the body is html escaped.
+func highlightSnippet(body string, terms []string) string {
+	runes := []rune(body)
+
+	type word struct {
+		start, end int
+		match      bool
+	}
+	words := make([]word, 0)
+	for i := 0; i < len(runes); {
+		if !isWordRune(runes[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(runes) && isWordRune(runes[i]) {
+			i++
+		}
+
+		w := word{start: start, end: i}
+		lower := strings.ToLower(string(runes[start:i]))
+		for _, term := range terms {
+			if strings.HasPrefix(lower, term) || strings.HasPrefix(term, lower) && len(lower) >= 3 {
+				w.match = true
+				break
+			}
+		}
+		words = append(words, w)
+	}
+
+	from, to := 0, len(runes)
+	for _, w := range words {
+		if w.match {
+			if w.start > snippetRadius {
+				from = w.start - snippetRadius
+			}
+			if w.end+snippetRadius < len(runes) {
+				to = w.end + snippetRadius
+			}
+			break
+		}
+	}
+	if to == len(runes) && from == 0 && len(runes) > 2*snippetRadius {
+		to = 2 * snippetRadius
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+
+	pos := from
+	for _, w := range words {
+		if !w.match || w.end <= from || w.start >= to {
+			continue
+		}
+
+		start, end := w.start, w.end
+		if start < from {
+			start = from
+		}
+		if end > to {
+			end = to
+		}
+
+		b.WriteString(html.EscapeString(string(runes[pos:start])))
+		b.WriteString("<mark>")
+		b.WriteString(html.EscapeString(string(runes[start:end])))
+		b.WriteString("</mark>")
+		pos = end
+	}
+	b.WriteString(html.EscapeString(string(runes[pos:to])))
+
+	if to < len(runes) {
+		b.WriteString("…")
+	}
+
+	return b.String()
+}
+
+func isWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func (f *MessageFunc) SearchMessagesHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[SearchMessagesHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to search messages",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	input := SearchMessagesInput{}
+	if err := ctx.ShouldBindQuery(&input); err != nil {
+		log.Printf("[SearchMessagesHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to search messages, please check your request data",
+		})
+		return
+	}
+	if input.Limit <= 0 {
+		input.Limit = 10
+	}
+	if input.Limit > int64(MaxMessagesLimit) {
+		log.Printf("[SearchMessagesHandler] invalid limit %d", input.Limit)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": fmt.Sprintf("Failed to search messages, limit should be between 1 and %d", MaxMessagesLimit),
+		})
+		return
+	}
+
+	output, err := f.SearchMessagesFunc(user, input)
+	if err != nil {
+		log.Printf("[SearchMessagesHandler] %v", err)
+		status := messageErrorStatus(err)
+		if err == ErrSearchQueryRequired || err == ErrInvalidSearchSender {
+			status = 400
+		}
+		ctx.JSON(status, gin.H{
+			"status":  "error",
+			"message": "Failed to search messages",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status": "success",
+		"meta": gin.H{
+			"limit":  output.Limit,
+			"cursor": output.Cursor,
+		},
+		"data": output.Results,
+	})
+}
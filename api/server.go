@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"fmt"
 	"log"
 
@@ -10,11 +11,24 @@ import (
 
 func StartServer() error {
 	LoadAppConfig()
+	if len(JwtSecretKey) == 0 {
+		log.Fatalf("[StartServer] JWT_SECRET is not set")
+	}
 
 	if err := ConnectDatabase(); err != nil {
 		log.Fatalf("[StartServer] %v", err)
 	}
+	if err := CreateRoomIndexes(); err != nil {
+		log.Fatalf("[StartServer] %v", err)
+	}
+	if err := CreateMessageIndexes(); err != nil {
+		log.Fatalf("[StartServer] %v", err)
+	}
+	if err := CreateSessionIndexes(); err != nil {
+		log.Fatalf("[StartServer] %v", err)
+	}
 	ConnectToRedis()
+	go wsHub.Subscribe(context.Background(), RedisClient)
 
 	if err := LoadCloudinary(AppConfig.CloudinaryCloudName, AppConfig.CloudinaryAPIKey, AppConfig.CloudinaryAPISecret); err != nil {
 		log.Fatalf("[StartServer] %v", err)
@@ -23,6 +37,7 @@ func StartServer() error {
 	userHandler := UserDefaultHandler()
 	messageHandler := MessageDefaultHandler()
 	roomHandler := RoomDefaultHandler()
+	sessionHandler := SessionDefaultHandler()
 	r := gin.Default()
 
 	corsConfig := cors.DefaultConfig()
@@ -41,12 +56,42 @@ func StartServer() error {
 	{
 		v1.POST("/auth/register", userHandler.RegisterUserHandler)
 		v1.POST("/auth/login", userHandler.LoginHandler)
+		v1.POST("/auth/login/mfa", userHandler.VerifyMFAHandler)
+		v1.POST("/auth/refresh", sessionHandler.RefreshHandler)
+		v1.POST("/auth/logout", AuthenticateUser(), userHandler.LogoutHandler)
+		v1.POST("/auth/forgot_password", userHandler.ForgotPasswordHandler)
+		v1.POST("/auth/reset_password", userHandler.ResetPasswordHandler)
+		v1.GET("/sessions", AuthenticateUser(), sessionHandler.GetSessionsHandler)
+		v1.DELETE("/sessions/:session_id", AuthenticateUser(), sessionHandler.DeleteSessionHandler)
 		v1.GET("/users/confirm_account", userHandler.ConfirmUserAccountHandler)
+		v1.POST("/users/resend_confirmation", userHandler.ResendConfirmationHandler)
 		v1.GET("/users/profile", AuthenticateUser(), userHandler.GetProfileHandler)
 		v1.PATCH("/users", AuthenticateUser(), userHandler.UpdateProfileHandler)
 		v1.POST("/users/avatar", AuthenticateUser(), userHandler.UploadUserAvatarHandler)
+		v1.POST("/users/mfa/totp", AuthenticateUser(), userHandler.EnrollTOTPHandler)
+		v1.POST("/users/mfa/totp/confirm", AuthenticateUser(), userHandler.ConfirmTOTPHandler)
 		v1.GET("/rooms", AuthenticateUser(), roomHandler.GetRoomsHandler)
+		v1.POST("/rooms", AuthenticateUser(), roomHandler.CreateRoomHandler)
+		v1.GET("/rooms/:room_id", AuthenticateUser(), roomHandler.GetRoomHandler)
+		v1.PATCH("/rooms/:room_id", AuthenticateUser(), roomHandler.UpdateRoomHandler)
+		v1.GET("/rooms/:room_id/pins", AuthenticateUser(), roomHandler.GetPinnedMessagesHandler)
+		v1.PUT("/rooms/:room_id/pins/:message_id", AuthenticateUser(), roomHandler.PinMessageHandler)
+		v1.DELETE("/rooms/:room_id/pins/:message_id", AuthenticateUser(), roomHandler.UnpinMessageHandler)
+		v1.POST("/rooms/:room_id/participants", AuthenticateUser(), roomHandler.AddParticipantsHandler)
+		v1.PATCH("/rooms/:room_id/participants/:user_id", AuthenticateUser(), roomHandler.UpdateParticipantRoleHandler)
+		v1.DELETE("/rooms/:room_id/participants/:user_id", AuthenticateUser(), roomHandler.RemoveParticipantHandler)
+		v1.POST("/rooms/:room_id/owner", AuthenticateUser(), roomHandler.TransferOwnershipHandler)
+		v1.POST("/rooms/:room_id/leave", AuthenticateUser(), roomHandler.LeaveRoomHandler)
+		v1.POST("/rooms/:room_id/read", AuthenticateUser(), roomHandler.MarkRoomReadHandler)
+		v1.PATCH("/rooms/:room_id/preferences", AuthenticateUser(), roomHandler.UpdatePreferencesHandler)
 		v1.GET("/rooms/:room_id/messages", AuthenticateUser(), messageHandler.GetMessagesHandler)
+		v1.POST("/rooms/:room_id/messages", AuthenticateUser(), messageHandler.SendMessageHandler)
+		v1.GET("/rooms/:room_id/messages/:message_id/replies", AuthenticateUser(), messageHandler.GetThreadHandler)
+		v1.PATCH("/rooms/:room_id/messages/:message_id", AuthenticateUser(), messageHandler.EditMessageHandler)
+		v1.DELETE("/rooms/:room_id/messages/:message_id", AuthenticateUser(), messageHandler.DeleteMessageHandler)
+		v1.POST("/rooms/:room_id/messages/:message_id/reactions", AuthenticateUser(), messageHandler.AddReactionHandler)
+		v1.DELETE("/rooms/:room_id/messages/:message_id/reactions/:emoji", AuthenticateUser(), messageHandler.RemoveReactionHandler)
+		v1.GET("/search/messages", AuthenticateUser(), messageHandler.SearchMessagesHandler)
 	}
 
 	r.GET("/rooms/:room_id", AuthenticateWS(), messageHandler.WSHandler)
@@ -0,0 +1,470 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v4"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// Session is a signed in device. It holds the hash of the only refresh
+	// token that can be used next, every refresh replaces it.
+	Session struct {
+		ID               primitive.ObjectID `bson:"_id,omitempty" json:"id"`
+		UserID           primitive.ObjectID `bson:"userId" json:"-"`
+		RefreshTokenHash string             `bson:"refreshTokenHash" json:"-"`
+		UserAgent        string             `bson:"userAgent,omitempty" json:"userAgent"`
+		IPAddress        string             `bson:"ipAddress,omitempty" json:"ipAddress"`
+		CreatedAt        time.Time          `bson:"createdAt" json:"createdAt"`
+		LastUsedAt       time.Time          `bson:"lastUsedAt" json:"lastUsedAt"`
+		ExpiresAt        time.Time          `bson:"expiresAt" json:"expiresAt"`
+		RevokedAt        *time.Time         `bson:"revokedAt,omitempty" json:"-"`
+
+		// filled when listing the sessions of the user
+		Current bool `bson:"-" json:"current"`
+	}
+
+	SessionClient struct {
+		UserAgent string
+		IPAddress string
+	}
+
+	RefreshTokenInput struct {
+		RefreshToken string `json:"refreshToken"`
+	}
+
+	AuthTokens struct {
+		AuthToken             string    `json:"authToken"`
+		AuthTokenExpiresAt    time.Time `json:"authTokenExpiresAt"`
+		RefreshToken          string    `json:"refreshToken"`
+		RefreshTokenExpiresAt time.Time `json:"refreshTokenExpiresAt"`
+	}
+
+	AuthClaims struct {
+		jwt.RegisteredClaims
+		ID        string `json:"id"`
+		SessionID string `json:"sid"`
+		FirstName string `json:"firstName"`
+		LastName  string `json:"lastName"`
+		Username  string `json:"username"`
+		Email     string `json:"email"`
+		// set on the token that only lets the user finish a two factor login
+		MFAPending bool `json:"mfaPending,omitempty"`
+	}
+
+	SessionFunc struct {
+		RefreshFunc       func(RefreshTokenInput, SessionClient) (*AuthTokens, error)
+		GetSessionsFunc   func(*User) ([]Session, error)
+		DeleteSessionFunc func(*User, string) error
+	}
+)
+
+const (
+	sessions string = "sessions"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("refresh token is invalid or expired")
+	ErrRefreshTokenReused  = errors.New("refresh token was already used, the session is revoked")
+	ErrSessionNotFound     = errors.New("session not found")
+)
+
+func CreateSessionIndexes() error {
+	indexes := []mongo.IndexModel{
+		{
+			Keys: bson.D{{"userId", 1}, {"lastUsedAt", -1}},
+		},
+		{
+			// expired sessions can't be refreshed anymore, so mongo removes them
+			Keys:    bson.D{{"expiresAt", 1}},
+			Options: options.Index().SetExpireAfterSeconds(0),
+		},
+	}
+
+	_, err := MongoDatabase.Collection(sessions).Indexes().CreateMany(context.Background(), indexes)
+	if err != nil {
+		return fmt.Errorf("[CreateSessionIndexes] %v", err)
+	}
+
+	return nil
+}
+
+// refresh tokens are "<session id>.<secret>", only the hash of the whole
+// token is stored
+func newRefreshToken(sessionID primitive.ObjectID) (string, string) {
+	token := fmt.Sprintf("%s.%s", sessionID.Hex(), GenSecureToken(32))
+	return token, hashToken(token)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func parseRefreshToken(token string) (primitive.ObjectID, error) {
+	sessionID, _, ok := strings.Cut(token, ".")
+	if !ok {
+		return primitive.NilObjectID, ErrInvalidRefreshToken
+	}
+
+	objID, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return primitive.NilObjectID, ErrInvalidRefreshToken
+	}
+
+	return objID, nil
+}
+
+func signAuthToken(user *User, sessionID primitive.ObjectID, expiresAt time.Time) (string, error) {
+	var lastName string
+	if user.LastName != nil {
+		lastName = *user.LastName
+	}
+
+	claims := AuthClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    AppName,
+			Subject:   user.ID.Hex(),
+			ID:        GenSecureToken(16),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+		ID:        user.ID.Hex(),
+		SessionID: sessionID.Hex(),
+		FirstName: user.FirstName,
+		LastName:  lastName,
+		Username:  user.Username,
+		Email:     user.Email,
+	}
+
+	token := jwt.NewWithClaims(JwtSigningMethod, claims)
+	return token.SignedString(JwtSecretKey)
+}
+
+// CreateSession signs the user in on a new device.
+func CreateSession(user *User, client SessionClient) (*AuthTokens, error) {
+	now := time.Now()
+	session := Session{
+		ID:         primitive.NewObjectID(),
+		UserID:     user.ID,
+		UserAgent:  client.UserAgent,
+		IPAddress:  client.IPAddress,
+		CreatedAt:  now,
+		LastUsedAt: now,
+		ExpiresAt:  now.Add(RefreshTokenExpDuration),
+	}
+
+	refreshToken, hash := newRefreshToken(session.ID)
+	session.RefreshTokenHash = hash
+
+	if _, err := MongoDatabase.Collection(sessions).InsertOne(context.Background(), session); err != nil {
+		return nil, fmt.Errorf("[CreateSession] %v", err)
+	}
+
+	authExpiresAt := now.Add(AuthTokenExpDuration)
+	authToken, err := signAuthToken(user, session.ID, authExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("[CreateSession] %v", err)
+	}
+
+	return &AuthTokens{
+		AuthToken:             authToken,
+		AuthTokenExpiresAt:    authExpiresAt,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// RefreshSession trades the refresh token for a new pair of tokens. A refresh
+// token works once, presenting one that was already traded means it leaked,
+// so the session is revoked for both the thief and the owner.
+func RefreshSession(input RefreshTokenInput, client SessionClient) (*AuthTokens, error) {
+	sessionID, err := parseRefreshToken(input.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	hash := hashToken(input.RefreshToken)
+	refreshToken, nextHash := newRefreshToken(sessionID)
+
+	// the token is swapped only if it is still the current one, so two
+	// requests with the same token can't both get new tokens
+	filter := bson.M{
+		"_id":              sessionID,
+		"refreshTokenHash": hash,
+		"revokedAt":        bson.M{"$exists": false},
+		"expiresAt":        bson.M{"$gt": now},
+	}
+	set := bson.M{
+		"refreshTokenHash": nextHash,
+		"lastUsedAt":       now,
+	}
+	if client.UserAgent != "" {
+		set["userAgent"] = client.UserAgent
+	}
+	if client.IPAddress != "" {
+		set["ipAddress"] = client.IPAddress
+	}
+	update := bson.M{
+		"$set": set,
+	}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var session Session
+	err = MongoDatabase.Collection(sessions).FindOneAndUpdate(context.Background(), filter, update, opts).Decode(&session)
+	if err == mongo.ErrNoDocuments {
+		return nil, refreshError(sessionID, hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("[RefreshSession] %v", err)
+	}
+
+	user, err := FindUserByID(session.UserID.Hex())
+	if err != nil {
+		return nil, fmt.Errorf("[RefreshSession] %v", err)
+	}
+
+	authExpiresAt := now.Add(AuthTokenExpDuration)
+	authToken, err := signAuthToken(user, session.ID, authExpiresAt)
+	if err != nil {
+		return nil, fmt.Errorf("[RefreshSession] %v", err)
+	}
+
+	return &AuthTokens{
+		AuthToken:             authToken,
+		AuthTokenExpiresAt:    authExpiresAt,
+		RefreshToken:          refreshToken,
+		RefreshTokenExpiresAt: session.ExpiresAt,
+	}, nil
+}
+
+// refreshError tells a reused refresh token apart from one that is simply
+// unknown or expired, and revokes the session on reuse.
+func refreshError(sessionID primitive.ObjectID, hash string) error {
+	session, err := FindSessionByID(sessionID)
+	if err != nil || session.RevokedAt != nil || !session.ExpiresAt.After(time.Now()) {
+		return ErrInvalidRefreshToken
+	}
+
+	if subtle.ConstantTimeCompare([]byte(session.RefreshTokenHash), []byte(hash)) == 1 {
+		return ErrInvalidRefreshToken
+	}
+
+	log.Printf("[RefreshSession] refresh token of session %s was reused", sessionID.Hex())
+	if err := RevokeSession(session.UserID, sessionID); err != nil {
+		log.Printf("[RefreshSession] %v", err)
+	}
+
+	return ErrRefreshTokenReused
+}
+
+func FindSessionByID(id primitive.ObjectID) (*Session, error) {
+	filter := bson.M{
+		"_id": id,
+	}
+
+	var session Session
+	if err := MongoDatabase.Collection(sessions).FindOne(context.Background(), filter).Decode(&session); err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// FindActiveSessionsByUserID returns the sessions that can still be
+// refreshed, most recently used first.
+func FindActiveSessionsByUserID(userID primitive.ObjectID) ([]Session, error) {
+	filter := bson.M{
+		"userId":    userID,
+		"revokedAt": bson.M{"$exists": false},
+		"expiresAt": bson.M{"$gt": time.Now()},
+	}
+	opts := options.Find().SetSort(bson.D{{"lastUsedAt", -1}})
+
+	cursor, err := MongoDatabase.Collection(sessions).Find(context.Background(), filter, opts)
+	if err != nil {
+		return []Session{}, err
+	}
+
+	var result = make([]Session, 0)
+	if err := cursor.All(context.Background(), &result); err != nil {
+		return []Session{}, err
+	}
+
+	return result, nil
+}
+
+// RevokeSession ends the session, its refresh token and the access tokens
+// issued for it stop working right away.
+func RevokeSession(userID, sessionID primitive.ObjectID) error {
+	filter := bson.M{
+		"_id":       sessionID,
+		"userId":    userID,
+		"revokedAt": bson.M{"$exists": false},
+	}
+	update := bson.M{
+		"$set": bson.M{"revokedAt": time.Now()},
+	}
+
+	res, err := MongoDatabase.Collection(sessions).UpdateOne(context.Background(), filter, update)
+	if err != nil {
+		return fmt.Errorf("[RevokeSession] %v", err)
+	}
+
+	if res.MatchedCount == 0 {
+		return ErrSessionNotFound
+	}
+
+	if err := revokeSessionTokens(userID.Hex(), sessionID.Hex()); err != nil {
+		return fmt.Errorf("[RevokeSession] %v", err)
+	}
+
+	return nil
+}
+
+func GetSessions(user *User) ([]Session, error) {
+	result, err := FindActiveSessionsByUserID(user.ID)
+	if err != nil {
+		return nil, fmt.Errorf("[GetSessions] %v", err)
+	}
+
+	return result, nil
+}
+
+func DeleteSession(user *User, sessionID string) error {
+	objID, err := primitive.ObjectIDFromHex(sessionID)
+	if err != nil {
+		return ErrSessionNotFound
+	}
+
+	return RevokeSession(user.ID, objID)
+}
+
+func NewSessionClient(ctx *gin.Context) SessionClient {
+	return SessionClient{
+		UserAgent: ctx.Request.UserAgent(),
+		IPAddress: ctx.ClientIP(),
+	}
+}
+
+func SessionDefaultHandler() *SessionFunc {
+	return &SessionFunc{
+		RefreshFunc:       RefreshSession,
+		GetSessionsFunc:   GetSessions,
+		DeleteSessionFunc: DeleteSession,
+	}
+}
+
+func sessionErrorStatus(err error) int {
+	switch err {
+	case ErrInvalidRefreshToken, ErrRefreshTokenReused:
+		return 401
+	case ErrSessionNotFound:
+		return 404
+	}
+
+	return 422
+}
+
+func (f *SessionFunc) RefreshHandler(ctx *gin.Context) {
+	input := RefreshTokenInput{}
+	if err := ctx.ShouldBind(&input); err != nil || input.RefreshToken == "" {
+		log.Printf("[RefreshHandler] %v", err)
+		ctx.JSON(400, gin.H{
+			"status":  "error",
+			"message": "Failed to refresh token, please check your request data",
+		})
+		return
+	}
+
+	tokens, err := f.RefreshFunc(input, NewSessionClient(ctx))
+	if err != nil {
+		log.Printf("[RefreshHandler] %v", err)
+		ctx.JSON(sessionErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to refresh token, please login again",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully refresh token",
+		"data":    tokens,
+	})
+}
+
+func (f *SessionFunc) GetSessionsHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[GetSessionsHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to get sessions",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	result, err := f.GetSessionsFunc(user)
+	if err != nil {
+		log.Printf("[GetSessionsHandler] %v", err)
+		ctx.JSON(sessionErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to get sessions",
+		})
+		return
+	}
+
+	currentSessionID := ctx.GetString("sessionId")
+	for i := range result {
+		result[i].Current = result[i].ID.Hex() == currentSessionID
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully get sessions",
+		"data":    result,
+	})
+}
+
+func (f *SessionFunc) DeleteSessionHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[DeleteSessionHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to delete session",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	if err := f.DeleteSessionFunc(user, ctx.Param("session_id")); err != nil {
+		log.Printf("[DeleteSessionHandler] %v", err)
+		ctx.JSON(sessionErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to delete session",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status":  "success",
+		"message": "Successfully delete session",
+	})
+}
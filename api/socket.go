@@ -0,0 +1,227 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+type (
+	MessageRefInput struct {
+		MessageID string `json:"messageId"`
+	}
+
+	SocketEditMessageInput struct {
+		MessageID string `json:"messageId"`
+		Body      string `json:"body"`
+	}
+
+	SocketReactionInput struct {
+		MessageID string `json:"messageId"`
+		Emoji     string `json:"emoji"`
+	}
+)
+
+var (
+	ErrInvalidEvent       = errors.New("event should be a json object with a valid payload")
+	ErrUnknownEvent       = errors.New("unknown event type")
+	ErrUnsupportedVersion = errors.New("unsupported event version")
+)
+
+func (f *MessageFunc) WSHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		return
+	}
+	user := userCtx.(*User)
+
+	roomID := ctx.Param("room_id")
+	if _, err := FindRoomForParticipant(roomID, user.ID); err != nil {
+		log.Printf("[WSHandler] %v", err)
+		ctx.JSON(messageErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Unable to join the room",
+		})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		log.Printf("[WSHandler] %v", err)
+		return
+	}
+
+	// the client resumes from the ID of the last event it got, the events it
+	// missed are replayed before any live one
+	resumeID := ctx.Query("resume")
+
+	client := NewClient(wsHub, conn, user, roomID)
+	if claims, ok := ctx.Get("claims"); ok {
+		client.SetToken(claims.(*AuthClaims))
+	}
+	if resumeID != "" {
+		client.startReplay()
+	}
+	wsHub.Register(client)
+	go client.WritePump()
+	PresenceConnect(client)
+
+	if resumeID != "" {
+		if err := ReplayEvents(client, resumeID); err != nil {
+			log.Printf("[WSHandler] %v", err)
+		}
+	}
+
+	if typingUserIDs, err := FindTypingUsers(roomID); err == nil {
+		client.SendJSON(NewEvent(TypingState, TypingStatePayload{
+			RoomID:  roomID,
+			UserIDs: typingUserIDs,
+		}))
+	} else {
+		log.Printf("[WSHandler] %v", err)
+	}
+
+	client.ReadPump(func(data []byte) {
+		f.handleEvent(client, user, data)
+	})
+
+	// a client that drops while typing shouldn't wait for the expiry, unless
+	// another session of the user is still in the room and may be typing
+	if !wsHub.HasRoomSession(client.UserID, roomID, client) {
+		if err := StopTyping(user, roomID); err != nil {
+			log.Printf("[WSHandler] %v", err)
+		}
+	}
+	PresenceDisconnect(client)
+}
+
+// handleEvent runs a single client event and replies with an ack carrying the
+// result, or an error, tagged with the nonce of the event.
+func (f *MessageFunc) handleEvent(client *Client, user *User, data []byte) {
+	var event IncomingEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		client.SendJSON(NewErrorEvent("", "invalid_event", ErrInvalidEvent.Error()))
+		return
+	}
+
+	// clients built before the envelope existed send a bare message
+	if event.Type == "" && event.Version == 0 {
+		event.Type = MessageSend
+		event.Payload = data
+	}
+
+	PresenceActivity(client)
+
+	payload, err := f.dispatchEvent(client, user, event)
+	if err != nil {
+		log.Printf("[WSHandler] %v", err)
+		code, message := eventErrorCode(err)
+		client.SendJSON(NewErrorEvent(event.Nonce, code, message))
+		return
+	}
+
+	// without a nonce the client can't match the ack, so there is no point
+	// in sending one
+	if event.Nonce != "" {
+		client.SendJSON(NewAckEvent(event.Nonce, payload))
+	}
+}
+
+func (f *MessageFunc) dispatchEvent(client *Client, user *User, event IncomingEvent) (interface{}, error) {
+	if event.Version > EventVersion {
+		return nil, ErrUnsupportedVersion
+	}
+
+	switch event.Type {
+	case MessageSend:
+		var input SendMessageInput
+		if err := decodeEventPayload(event, &input); err != nil {
+			return nil, err
+		}
+		if event.Nonce != "" {
+			input.Nonce = event.Nonce
+		}
+
+		output, err := f.SendMessageFunc(user, client.RoomID, input)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := StopTyping(user, client.RoomID); err != nil {
+			log.Printf("[WSHandler] %v", err)
+		}
+		return output, nil
+	case MessageEdit:
+		var input SocketEditMessageInput
+		if err := decodeEventPayload(event, &input); err != nil {
+			return nil, err
+		}
+		return f.EditMessageFunc(user, client.RoomID, input.MessageID, EditMessageInput{Body: input.Body})
+	case MessageDelete:
+		var input MessageRefInput
+		if err := decodeEventPayload(event, &input); err != nil {
+			return nil, err
+		}
+		return f.DeleteMessageFunc(user, client.RoomID, input.MessageID)
+	case TypingStart:
+		return nil, StartTyping(user, client.RoomID)
+	case TypingStop:
+		return nil, StopTyping(user, client.RoomID)
+	case RoomMarkRead:
+		var input MarkRoomReadInput
+		if len(event.Payload) != 0 {
+			if err := decodeEventPayload(event, &input); err != nil {
+				return nil, err
+			}
+		}
+		return MarkRoomAsRead(user, client.RoomID, input)
+	case ReactionAdd, ReactionRemove:
+		var input SocketReactionInput
+		if err := decodeEventPayload(event, &input); err != nil {
+			return nil, err
+		}
+
+		reaction := ReactionInput{Emoji: input.Emoji}
+		if event.Type == ReactionAdd {
+			return f.AddReactionFunc(user, client.RoomID, input.MessageID, reaction)
+		}
+		return f.RemoveReactionFunc(user, client.RoomID, input.MessageID, reaction)
+	}
+
+	return nil, ErrUnknownEvent
+}
+
+func decodeEventPayload(event IncomingEvent, v interface{}) error {
+	if len(event.Payload) == 0 {
+		return ErrInvalidEvent
+	}
+
+	if err := json.Unmarshal(event.Payload, v); err != nil {
+		return ErrInvalidEvent
+	}
+
+	return nil
+}
+
+// eventErrorCode maps an error to the code and message sent to the client,
+// unexpected errors are hidden behind a generic message.
+func eventErrorCode(err error) (string, string) {
+	switch err {
+	case ErrInvalidEvent, ErrMessageBodyMissing, ErrInvalidReaction, ErrInvalidReplyParent:
+		return "invalid_event", err.Error()
+	case ErrUnknownEvent:
+		return "unknown_event", err.Error()
+	case ErrUnsupportedVersion:
+		return "unsupported_version", err.Error()
+	case ErrNotRoomParticipant, ErrNotMessageAuthor, ErrRoomPermission:
+		return "forbidden", err.Error()
+	case ErrMessageNotFound, mongo.ErrNoDocuments, primitive.ErrInvalidHex:
+		return "not_found", ErrMessageNotFound.Error()
+	}
+
+	return "internal_error", "something went wrong, please try again"
+}
@@ -0,0 +1,221 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+type (
+	SyncPayload struct {
+		LastEventID string `json:"lastEventId,omitempty"`
+	}
+
+	// pendingEvent is a live event that arrived while the session was still
+	// replaying the ones it missed.
+	pendingEvent struct {
+		ID  string
+		Out outbound
+	}
+)
+
+var (
+	// number of events kept for every user, a session resuming from an older
+	// position has to reload its state
+	EventStreamMaxLen int64 = 1000
+	// the stream of a user that didn't receive anything for this long is
+	// dropped entirely
+	EventStreamExpDuration = time.Duration(7*24) * time.Hour
+)
+
+// eventStreamKey holds the replayable events addressed to the user, in the
+// order they were sent. The stream entry ID doubles as the event ID the
+// client resumes from.
+func eventStreamKey(userID string) string {
+	return fmt.Sprintf("events:%s", userID)
+}
+
+// Replayable tells whether a session that missed the event should get it on
+// reconnect, short lived states like typing are not worth replaying.
+func (t EventType) Replayable() bool {
+	switch t {
+	case TypingStarted, TypingStopped, TypingState, PresenceChanged:
+		return false
+	}
+
+	return true
+}
+
+// AppendUserEvents stores the encoded event in the stream of every listed
+// user and returns the ID it got in each stream.
+func AppendUserEvents(userIDs []string, data []byte) (map[string]string, error) {
+	pipe := RedisClient.Pipeline()
+	cmds := make(map[string]*redis.StringCmd, len(userIDs))
+	for _, userID := range userIDs {
+		key := eventStreamKey(userID)
+		cmds[userID] = pipe.XAdd(context.Background(), &redis.XAddArgs{
+			Stream: key,
+			MaxLen: EventStreamMaxLen,
+			Approx: true,
+			Values: map[string]interface{}{"data": string(data)},
+		})
+		pipe.Expire(context.Background(), key, EventStreamExpDuration)
+	}
+
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return nil, fmt.Errorf("[AppendUserEvents] %v", err)
+	}
+
+	ids := make(map[string]string, len(cmds))
+	for userID, cmd := range cmds {
+		ids[userID] = cmd.Val()
+	}
+
+	return ids, nil
+}
+
+// withEventID sets the ID of an encoded event.
+func withEventID(data []byte, id string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+
+	encodedID, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	fields["id"] = encodedID
+
+	return json.Marshal(fields)
+}
+
+// replayReceipt returns the receipt of a replayed chat message, so catching
+// up on it after a reconnect records the delivery like a live one.
+func replayReceipt(data []byte) *hubReceipt {
+	var event struct {
+		Type    EventType `json:"type"`
+		Payload struct {
+			ID     string `json:"id"`
+			UserID string `json:"userId"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &event); err != nil || event.Type != MessageCreated {
+		return nil
+	}
+
+	return &hubReceipt{
+		MessageID: event.Payload.ID,
+		SenderID:  event.Payload.UserID,
+	}
+}
+
+// parseEventID splits a stream entry ID into its time and sequence parts.
+func parseEventID(id string) (uint64, uint64, bool) {
+	parts := strings.SplitN(id, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	ms, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	seq, err := strconv.ParseUint(parts[1], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+
+	return ms, seq, true
+}
+
+// eventIDAfter tells whether the event a comes after the event b, an empty b
+// comes before everything.
+func eventIDAfter(a, b string) bool {
+	if b == "" {
+		return true
+	}
+
+	aMs, aSeq, _ := parseEventID(a)
+	bMs, bSeq, _ := parseEventID(b)
+	if aMs != bMs {
+		return aMs > bMs
+	}
+
+	return aSeq > bSeq
+}
+
+// ReplayEvents sends the events the user received after the given position to
+// the client, followed by the live events that arrived meanwhile. When the
+// position is no longer in the stream, or the stream can't be read, the client
+// is told to reload instead.
+func ReplayEvents(c *Client, resumeID string) error {
+	defer c.finishReplay()
+
+	ms, _, ok := parseEventID(resumeID)
+	if !ok {
+		c.sendBlocking(NewEvent(SyncReset, SyncPayload{}))
+		return nil
+	}
+
+	key := eventStreamKey(c.UserID)
+	first, err := RedisClient.XRangeN(context.Background(), key, "-", "+", 1).Result()
+	if err != nil {
+		c.sendBlocking(NewEvent(SyncReset, SyncPayload{}))
+		return fmt.Errorf("[ReplayEvents] %v", err)
+	}
+
+	// without a stream nothing was sent since it expired, which only matters
+	// when the position is older than that
+	if len(first) == 0 {
+		if time.Since(time.UnixMilli(int64(ms))) > EventStreamExpDuration {
+			c.sendBlocking(NewEvent(SyncReset, SyncPayload{}))
+		} else {
+			c.sendBlocking(NewEvent(SyncDone, SyncPayload{LastEventID: resumeID}))
+		}
+		return nil
+	}
+
+	// the position was trimmed off the stream, some events may be lost
+	if eventIDAfter(first[0].ID, resumeID) {
+		c.sendBlocking(NewEvent(SyncReset, SyncPayload{}))
+		return nil
+	}
+
+	entries, err := RedisClient.XRange(context.Background(), key, "("+resumeID, "+").Result()
+	if err != nil {
+		c.sendBlocking(NewEvent(SyncReset, SyncPayload{}))
+		return fmt.Errorf("[ReplayEvents] %v", err)
+	}
+
+	lastEventID := resumeID
+	for _, entry := range entries {
+		raw, ok := entry.Values["data"].(string)
+		if !ok {
+			continue
+		}
+
+		data, err := withEventID([]byte(raw), entry.ID)
+		if err != nil {
+			log.Printf("[ReplayEvents] %v", err)
+			continue
+		}
+
+		if !c.enqueueBlocking(outbound{data: data, receipt: replayReceipt(data)}) {
+			return nil
+		}
+		lastEventID = entry.ID
+	}
+
+	c.setLastEventID(lastEventID)
+	c.sendBlocking(NewEvent(SyncDone, SyncPayload{LastEventID: lastEventID}))
+
+	return nil
+}
@@ -0,0 +1,251 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type (
+	// MessagePreview quotes the message a reply refers to.
+	MessagePreview struct {
+		ID         primitive.ObjectID `bson:"_id" json:"id"`
+		Body       string             `bson:"body" json:"body"`
+		Attachment *string            `bson:"attachment" json:"attachment"`
+		UserID     primitive.ObjectID `bson:"userId" json:"userId"`
+		CreatedAt  time.Time          `bson:"createdAt" json:"createdAt"`
+		DeletedAt  *time.Time         `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	}
+
+	GetThreadInput struct {
+		User      *User
+		RoomID    string
+		MessageID string
+		Cursor    string
+		Limit     int64
+	}
+
+	GetThreadOutput struct {
+		Cursor  string
+		Limit   int64
+		Message *Message
+		Replies []Message
+	}
+
+	ThreadPayload struct {
+		RoomID      string     `json:"roomId"`
+		MessageID   string     `json:"messageId"`
+		ReplyCount  int64      `json:"replyCount"`
+		LastReplyAt *time.Time `json:"lastReplyAt,omitempty"`
+	}
+)
+
+var (
+	ErrInvalidReplyParent = errors.New("reply should refer to a message of the same room")
+)
+
+const (
+	// number of characters of the replied message kept in the quote
+	previewLength = 100
+)
+
+func NewMessagePreview(message *Message) *MessagePreview {
+	preview := &MessagePreview{
+		ID:         message.ID,
+		Body:       message.Body,
+		Attachment: message.Attachment,
+		UserID:     message.UserID,
+		CreatedAt:  message.CreatedAt,
+		DeletedAt:  message.DeletedAt,
+	}
+	preview.Trim()
+
+	return preview
+}
+
+// Trim shortens the quoted body, a long message only needs enough of it to be
+// recognized.
+func (p *MessagePreview) Trim() {
+	runes := []rune(p.Body)
+	if len(runes) > previewLength {
+		p.Body = string(runes[:previewLength]) + "…"
+	}
+}
+
+// findReplyParent returns the message a reply refers to, it has to be a
+// message of the same room that wasn't deleted.
+func findReplyParent(room *Room, messageID string) (*Message, error) {
+	parent, err := FindMessageByID(messageID)
+	if err != nil {
+		return nil, ErrInvalidReplyParent
+	}
+
+	if parent.RoomID != room.ID || parent.DeletedAt != nil {
+		return nil, ErrInvalidReplyParent
+	}
+
+	return parent, nil
+}
+
+func updateThread(room *Room, parentID primitive.ObjectID, update bson.M) error {
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+
+	var parent Message
+	err := MongoDatabase.Collection(messages).FindOneAndUpdate(context.Background(), bson.M{"_id": parentID}, update, opts).Decode(&parent)
+	if err != nil {
+		return fmt.Errorf("[updateThread] %v", err)
+	}
+
+	SendEvent(room.ID.Hex(), room.ParticipantIDs(), NewEvent(MessageThreadUpdated, ThreadPayload{
+		RoomID:      room.ID.Hex(),
+		MessageID:   parent.ID.Hex(),
+		ReplyCount:  parent.ReplyCount,
+		LastReplyAt: parent.LastReplyAt,
+	}))
+
+	return nil
+}
+
+func addReplyToThread(room *Room, parent, reply *Message) error {
+	return updateThread(room, parent.ID, bson.M{
+		"$inc": bson.M{"replyCount": 1},
+		"$max": bson.M{"lastReplyAt": reply.CreatedAt},
+	})
+}
+
+func removeReplyFromThread(room *Room, parentID primitive.ObjectID) error {
+	return updateThread(room, parentID, bson.M{
+		"$inc": bson.M{"replyCount": -1},
+	})
+}
+
+// FindReplies returns the replies to the message after the anchor, oldest
+// first.
+func FindReplies(parentID primitive.ObjectID, anchor *MessageCursor, limit int64) ([]Message, error) {
+	match := bson.D{
+		{"replyTo", parentID},
+		{"deletedAt", bson.D{{"$exists", false}}},
+	}
+
+	return findMessages(match, anchor, false, false, limit)
+}
+
+// GetThread returns the message with a page of its replies, the cursor leads
+// to the next replies and is empty on the last page.
+func GetThread(input GetThreadInput) (GetThreadOutput, error) {
+	output := GetThreadOutput{
+		Limit:   input.Limit,
+		Replies: []Message{},
+	}
+
+	room, err := FindRoomForParticipant(input.RoomID, input.User.ID)
+	if err != nil {
+		return output, err
+	}
+
+	parent, err := FindMessageByID(input.MessageID)
+	if err != nil || parent.RoomID != room.ID {
+		return output, ErrMessageNotFound
+	}
+
+	var anchor *MessageCursor
+	if input.Cursor != "" {
+		anchor, err = DecodeMessageCursor(input.Cursor)
+		if err != nil {
+			return output, err
+		}
+	}
+
+	replies, err := FindReplies(parent.ID, anchor, input.Limit+1)
+	if err != nil {
+		return output, fmt.Errorf("[GetThread] %v", err)
+	}
+
+	hasMore := int64(len(replies)) > input.Limit
+	if hasMore {
+		replies = replies[:input.Limit]
+	}
+
+	for i := range replies {
+		replies[i].Status = replies[i].DeliveryStatus()
+		replies[i].ReactionSummaries = SummarizeReactions(replies[i].Reactions, &input.User.ID)
+	}
+
+	if hasMore && len(replies) != 0 {
+		output.Cursor, err = NewMessageCursor(replies[len(replies)-1]).Encode()
+		if err != nil {
+			return output, fmt.Errorf("[GetThread] %v", err)
+		}
+	}
+
+	parent.Status = parent.DeliveryStatus()
+	parent.ReactionSummaries = SummarizeReactions(parent.Reactions, &input.User.ID)
+	output.Message = parent
+	output.Replies = replies
+
+	return output, nil
+}
+
+func (f *MessageFunc) GetThreadHandler(ctx *gin.Context) {
+	userCtx, ok := ctx.Get("user")
+	if !ok {
+		log.Println("[GetThreadHandler] Unable to get current user")
+		ctx.JSON(422, gin.H{
+			"status":  "error",
+			"message": "Failed to get thread",
+		})
+		return
+	}
+	user := userCtx.(*User)
+
+	limit := 10
+	if limitQuery := ctx.Query("limit"); limitQuery != "" {
+		var err error
+		limit, err = strconv.Atoi(limitQuery)
+		if err != nil || limit <= 0 || limit > MaxMessagesLimit {
+			log.Printf("[GetThreadHandler] invalid limit %q", limitQuery)
+			ctx.JSON(400, gin.H{
+				"status":  "error",
+				"message": fmt.Sprintf("Failed to get thread, limit should be between 1 and %d", MaxMessagesLimit),
+			})
+			return
+		}
+	}
+
+	input := GetThreadInput{
+		User:      user,
+		RoomID:    ctx.Param("room_id"),
+		MessageID: ctx.Param("message_id"),
+		Cursor:    ctx.Query("cursor"),
+		Limit:     int64(limit),
+	}
+	output, err := f.GetThreadFunc(input)
+	if err != nil {
+		log.Printf("[GetThreadHandler] %v", err)
+		ctx.JSON(messageErrorStatus(err), gin.H{
+			"status":  "error",
+			"message": "Failed to get thread",
+		})
+		return
+	}
+
+	ctx.JSON(200, gin.H{
+		"status": "success",
+		"meta": gin.H{
+			"limit":  output.Limit,
+			"cursor": output.Cursor,
+		},
+		"data": gin.H{
+			"message": output.Message,
+			"replies": output.Replies,
+		},
+	})
+}
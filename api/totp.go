@@ -0,0 +1,98 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP as described in RFC 6238 with the defaults every authenticator app
+// supports: HMAC-SHA1, 6 digits and a 30 seconds step.
+const (
+	totpDigits     = 6
+	totpPeriod     = 30
+	totpSecretSize = 20
+	// steps accepted before and after the current one, to allow for clock
+	// drift between the server and the phone
+	totpSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func NewTOTPSecret() (string, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPURI is the otpauth uri the authenticator apps read from a QR code.
+func TOTPURI(secret, accountName string) string {
+	label := url.PathEscape(AppName) + ":" + url.PathEscape(accountName)
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("issuer", AppName)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, query.Encode())
+}
+
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// hotp computes the one time password of the counter, RFC 4226 section 5.3.
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", totpDigits, code%mod)
+}
+
+// VerifyTOTP checks the code against the steps around t and returns the
+// counter of the step it matched, so the caller can refuse to accept the
+// same step twice.
+func VerifyTOTP(secret, code string, t time.Time) (int64, bool) {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return 0, false
+	}
+
+	current := totpCounter(t)
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if subtle.ConstantTimeCompare([]byte(hotp(key, counter)), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+
+	return 0, false
+}
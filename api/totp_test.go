@@ -0,0 +1,46 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+// SHA1 test vectors of RFC 6238 appendix B, truncated to 6 digits.
+func TestVerifyTOTP(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+
+		counter, ok := VerifyTOTP(secret, tt.code, now)
+		if !ok {
+			t.Errorf("VerifyTOTP(%q) at %d rejected a valid code", tt.code, tt.unix)
+			continue
+		}
+		if counter != totpCounter(now) {
+			t.Errorf("VerifyTOTP(%q) at %d matched step %d, want %d", tt.code, tt.unix, counter, totpCounter(now))
+		}
+	}
+}
+
+func TestVerifyTOTPRejectsOtherSteps(t *testing.T) {
+	secret := totpEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(1111111109, 0)
+
+	if _, ok := VerifyTOTP(secret, "287082", now); ok {
+		t.Errorf("VerifyTOTP accepted a code outside of the allowed skew")
+	}
+	if _, ok := VerifyTOTP(secret, "08180", now); ok {
+		t.Errorf("VerifyTOTP accepted a code with missing digits")
+	}
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v9"
+)
+
+type (
+	TypingPayload struct {
+		RoomID    string `json:"roomId"`
+		UserID    string `json:"userId"`
+		Username  string `json:"username,omitempty"`
+		ExpiresIn int    `json:"expiresIn,omitempty"`
+	}
+
+	TypingStatePayload struct {
+		RoomID  string   `json:"roomId"`
+		UserIDs []string `json:"userIds"`
+	}
+)
+
+var (
+	// a client keeps sending typing.start while the user is typing, anything
+	// not refreshed within this window is considered stopped
+	TypingExpDuration = time.Duration(6) * time.Second
+)
+
+// typingKey holds the users typing in a room as a sorted set scored by the
+// time their typing state expires. The key itself expires as well, so a room
+// nobody types in anymore doesn't leave anything behind.
+func typingKey(roomID string) string {
+	return fmt.Sprintf("typing:%s", roomID)
+}
+
+func StartTyping(user *User, roomID string) error {
+	room, err := FindRoomForParticipant(roomID, user.ID)
+	if err != nil {
+		return err
+	}
+
+	key := typingKey(roomID)
+	expiresAt := time.Now().Add(TypingExpDuration)
+	pipe := RedisClient.TxPipeline()
+	pipe.ZAdd(context.Background(), key, redis.Z{
+		Score:  float64(expiresAt.UnixMilli()),
+		Member: user.ID.Hex(),
+	})
+	pipe.Expire(context.Background(), key, TypingExpDuration)
+	if _, err := pipe.Exec(context.Background()); err != nil {
+		return fmt.Errorf("[StartTyping] %v", err)
+	}
+
+	SendEvent(roomID, otherParticipantIDs(room, user.ID.Hex()), NewEvent(TypingStarted, TypingPayload{
+		RoomID:    roomID,
+		UserID:    user.ID.Hex(),
+		Username:  user.Username,
+		ExpiresIn: int(TypingExpDuration.Seconds()),
+	}))
+
+	return nil
+}
+
+func StopTyping(user *User, roomID string) error {
+	removed, err := RedisClient.ZRem(context.Background(), typingKey(roomID), user.ID.Hex()).Result()
+	if err != nil {
+		return fmt.Errorf("[StopTyping] %v", err)
+	}
+
+	// nothing to tell the room when the user wasn't typing or already expired
+	if removed == 0 {
+		return nil
+	}
+
+	room, err := FindRoomByID(roomID)
+	if err != nil {
+		return fmt.Errorf("[StopTyping] %v", err)
+	}
+
+	SendEvent(roomID, otherParticipantIDs(room, user.ID.Hex()), NewEvent(TypingStopped, TypingPayload{
+		RoomID:   roomID,
+		UserID:   user.ID.Hex(),
+		Username: user.Username,
+	}))
+
+	return nil
+}
+
+// FindTypingUsers returns the users whose typing state hasn't expired yet.
+func FindTypingUsers(roomID string) ([]string, error) {
+	min := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	userIDs, err := RedisClient.ZRangeByScore(context.Background(), typingKey(roomID), &redis.ZRangeBy{
+		Min: min,
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return []string{}, fmt.Errorf("[FindTypingUsers] %v", err)
+	}
+
+	return userIDs, nil
+}
+
+func otherParticipantIDs(room *Room, userID string) []string {
+	ids := make([]string, 0, len(room.Participants))
+	for _, id := range room.ParticipantIDs() {
+		if id != userID {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
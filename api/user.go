@@ -2,6 +2,7 @@ package api
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/base64"
 	"errors"
 	"fmt"
@@ -34,13 +35,16 @@ type (
 	}
 
 	LoginUserInput struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
+		Username string        `json:"username"`
+		Password string        `json:"password"`
+		Client   SessionClient `json:"-"`
 	}
 
 	LoginUserOutput struct {
 		User
-		AuthToken string `json:"authToken"`
+		AuthTokens
+		// set instead of the tokens when the login needs a second factor
+		MFA *MFAChallenge `json:"-"`
 	}
 
 	UpdateProfileInput struct {
@@ -58,6 +62,13 @@ type (
 	UserFunc struct {
 		RegisterFunc           func(RegisterUserInput) error
 		LoginFunc              func(LoginUserInput) (LoginUserOutput, error)
+		LogoutFunc             func(*AuthClaims, bool) error
+		ForgotPasswordFunc     func(ForgotPasswordInput) error
+		ResetPasswordFunc      func(ResetPasswordInput) error
+		ResendConfirmationFunc func(ResendConfirmationInput) error
+		VerifyMFAFunc          func(VerifyMFAInput) (LoginUserOutput, error)
+		EnrollTOTPFunc         func(*User) (*EnrollTOTPOutput, error)
+		ConfirmTOTPFunc        func(*User, ConfirmTOTPInput) (*ConfirmTOTPOutput, error)
 		ConfirmUserAccountFunc func(string) (*User, error)
 		UpdateProfileFunc      func(string, UpdateProfileInput) error
 		GetProfileFunc         func(string) (*User, error)
@@ -78,6 +89,16 @@ type (
 		CreatedAt time.Time          `bson:"createdAt,omitempty" json:"createdAt"`
 		UpdatedAt time.Time          `bson:"updatedAt,omitempty" json:"updatedAt"`
 		DeletedAt time.Time          `bson:"deletedAt,omitempty" json:"-"`
+
+		LastSeenAt *time.Time     `bson:"lastSeenAt,omitempty" json:"lastSeenAt"`
+		Presence   PresenceStatus `bson:"-" json:"presence,omitempty"`
+
+		// two factor authentication, the recovery codes are stored hashed
+		MFAEnabled        bool     `bson:"mfaEnabled,omitempty" json:"mfaEnabled"`
+		TOTPSecret        string   `bson:"totpSecret,omitempty" json:"-"`
+		TOTPPendingSecret string   `bson:"totpPendingSecret,omitempty" json:"-"`
+		TOTPLastCounter   int64    `bson:"totpLastCounter,omitempty" json:"-"`
+		RecoveryCodes     []string `bson:"recoveryCodes,omitempty" json:"-"`
 	}
 )
 
@@ -89,10 +110,12 @@ const (
 )
 
 var (
-	AppName          = "talkbox"
-	LoginExpDuration = time.Duration(730) * time.Hour
-	JwtSigningMethod = jwt.SigningMethodHS256
-	JwtSecretKey     = []byte(AppConfig.JwtSecret)
+	AppName                 = "talkbox"
+	AuthTokenExpDuration    = time.Duration(15) * time.Minute
+	RefreshTokenExpDuration = time.Duration(30*24) * time.Hour
+	JwtSigningMethod        = jwt.SigningMethodHS256
+	// set by LoadAppConfig from JWT_SECRET
+	JwtSecretKey []byte
 )
 
 func (u *User) Save() error {
@@ -156,6 +179,33 @@ func FindUserByID(id string) (*User, error) {
 	return &user, nil
 }
 
+func FindUsersByIDs(ids []string) ([]User, error) {
+	objIDs := make([]primitive.ObjectID, 0, len(ids))
+	for _, id := range ids {
+		objID, err := primitive.ObjectIDFromHex(id)
+		if err != nil {
+			return []User{}, err
+		}
+		objIDs = append(objIDs, objID)
+	}
+
+	filter := bson.M{
+		"_id": bson.M{"$in": objIDs},
+	}
+
+	cursor, err := MongoDatabase.Collection(users).Find(context.Background(), filter)
+	if err != nil {
+		return []User{}, err
+	}
+
+	var result = make([]User, 0)
+	if err := cursor.All(context.Background(), &result); err != nil {
+		return []User{}, err
+	}
+
+	return result, nil
+}
+
 func UpdateUserToActive(id string) (*User, error) {
 	objID, err := primitive.ObjectIDFromHex(id)
 	if err != nil {
@@ -227,7 +277,7 @@ func RegisterUser(input RegisterUserInput) error {
 		FirstName: input.FirstName,
 		LastName:  input.LastName,
 		Username:  input.Username,
-		Email:     input.Email,
+		Email:     normalizeEmail(input.Email),
 		Status:    Inactive,
 	}
 
@@ -257,14 +307,23 @@ func RegisterUser(input RegisterUserInput) error {
 		return err
 	}
 
-	token := GenRandString(20)
+	if err := sendConfirmationToken(user); err != nil {
+		log.Printf("[RegisterUser] %v", err)
+		return err
+	}
+	return nil
+}
+
+// sendConfirmationToken stores a new confirmation token for the user and
+// emails it, the token replaces any previous one.
+func sendConfirmationToken(user *User) error {
+	token := GenSecureToken(32)
 	fmtToken := fmt.Sprintf("%s$%s", user.ID.Hex(), token)
-	encToken := base64.StdEncoding.EncodeToString([]byte(fmtToken))
+	encToken := base64.URLEncoding.EncodeToString([]byte(fmtToken))
 	cacheKey := fmt.Sprintf("email_confirmation:%s", user.ID.Hex())
 	exp := time.Duration(1) * time.Hour
 	optStatus := RedisClient.Set(context.Background(), cacheKey, token, exp)
 	if err := optStatus.Err(); err != nil {
-		log.Printf("[RegisterUser] %v", err)
 		return err
 	}
 	go sendConfirmationEmail(user.Email, encToken)
@@ -282,16 +341,23 @@ func sendConfirmationEmail(to, token string) {
 	</div>
 	`, AppConfig.EmailConfirmationURL+"?"+urlVal.Encode())
 
+	if err := sendEmail(to, "Verify your account - Talkbox", body); err != nil {
+		log.Printf("[sendConfirmationEmail] %v", err)
+		return
+	}
+	log.Printf("[sendConfirmationEmail] Confirmation email successfully sent to %s", to)
+}
+
+func sendEmail(to, subject, body string) error {
 	mailer := gomail.NewMessage()
 	mailer.SetHeader("From", AppConfig.EmailSenderName)
 	mailer.SetHeader("To", to)
-	mailer.SetHeader("Subject", "Verify your account - Talkbox")
+	mailer.SetHeader("Subject", subject)
 	mailer.SetBody("text/html", body)
 
 	smtpPort, err := strconv.Atoi(AppConfig.SMTPPort)
 	if err != nil {
-		log.Printf("[sendConfirmationEmail] %v", err)
-		return
+		return err
 	}
 
 	dialer := gomail.NewDialer(
@@ -301,11 +367,7 @@ func sendConfirmationEmail(to, token string) {
 		AppConfig.SMTPPassword,
 	)
 
-	if err = dialer.DialAndSend(mailer); err != nil {
-		log.Printf("[sendConfirmationEmail] %v", err)
-		return
-	}
-	log.Printf("[sendConfirmationEmail] Confirmation email successfully sent to %s", to)
+	return dialer.DialAndSend(mailer)
 }
 
 func GetUserProfile(userID string) (*User, error) {
@@ -314,6 +376,12 @@ func GetUserProfile(userID string) (*User, error) {
 		return nil, err
 	}
 
+	if status, err := findPresenceStatus(userID); err == nil {
+		user.Presence = status
+	} else {
+		log.Printf("[GetUserProfile] %v", err)
+	}
+
 	return user, nil
 }
 
@@ -325,7 +393,7 @@ func UpdateUserProfile(userID string, input UpdateProfileInput) error {
 
 	user.FirstName = input.FirstName
 	user.LastName = input.LastName
-	user.Email = input.Email
+	user.Email = normalizeEmail(input.Email)
 	user.Avatar = input.Avatar
 
 	if input.Password != "" {
@@ -368,6 +436,13 @@ func UserDefaultHandler() *UserFunc {
 		RegisterFunc:           RegisterUser,
 		ConfirmUserAccountFunc: ConfirmUserAccount,
 		LoginFunc:              Login,
+		LogoutFunc:             Logout,
+		ForgotPasswordFunc:     ForgotPassword,
+		ResetPasswordFunc:      ResetPassword,
+		ResendConfirmationFunc: ResendConfirmation,
+		VerifyMFAFunc:          VerifyMFA,
+		EnrollTOTPFunc:         EnrollTOTP,
+		ConfirmTOTPFunc:        ConfirmTOTP,
 		GetProfileFunc:         GetUserProfile,
 		UpdateProfileFunc:      UpdateUserProfile,
 		UploadUserAvatarFunc:   UploadUserAvatar,
@@ -402,14 +477,15 @@ func (f *UserFunc) RegisterUserHandler(ctx *gin.Context) {
 }
 
 func ConfirmUserAccount(token string) (*User, error) {
-	decodedToken, err := base64.StdEncoding.DecodeString(token)
+	decodedToken, err := base64.URLEncoding.DecodeString(token)
 	if err != nil {
 		return nil, fmt.Errorf("[ConfirmUserAccount] %v", err)
 	}
 
-	lst := strings.Split(string(decodedToken), "$")
-	userID := lst[0]
-	userToken := lst[1]
+	userID, userToken, ok := strings.Cut(string(decodedToken), "$")
+	if !ok {
+		return nil, fmt.Errorf("[ConfirmUserAccount] malformed confirmation token")
+	}
 
 	cacheKey := fmt.Sprintf("email_confirmation:%s", userID)
 
@@ -419,8 +495,8 @@ func ConfirmUserAccount(token string) (*User, error) {
 		return nil, fmt.Errorf("[ConfirmUserAccount] %v", err)
 	}
 
-	if cacheToken != userToken {
-		return nil, fmt.Errorf("[ConfirmUserAccount] %v", err)
+	if subtle.ConstantTimeCompare([]byte(cacheToken), []byte(userToken)) != 1 {
+		return nil, fmt.Errorf("[ConfirmUserAccount] confirmation token doesn't match")
 	}
 
 	user, err := UpdateUserToActive(userID)
@@ -472,34 +548,26 @@ func Login(input LoginUserInput) (LoginUserOutput, error) {
 		return LoginUserOutput{}, err
 	}
 
-	claims := struct {
-		jwt.StandardClaims
-		ID        string `json:"id"`
-		FirstName string `json:"firstName"`
-		LastName  string `json:"lastName"`
-		Username  string `json:"username"`
-		Email     string `json:"email"`
-	}{
-		StandardClaims: jwt.StandardClaims{
-			Issuer:    AppName,
-			ExpiresAt: time.Now().Add(LoginExpDuration).Unix(),
-		},
-		ID:        user.ID.Hex(),
-		FirstName: user.FirstName,
-		LastName:  *user.LastName,
-		Username:  user.Username,
-		Email:     user.Email,
+	if user.Status == Inactive {
+		return LoginUserOutput{}, ErrAccountNotConfirmed
 	}
 
-	token := jwt.NewWithClaims(JwtSigningMethod, claims)
-	signedToken, err := token.SignedString(JwtSecretKey)
+	if user.MFAEnabled {
+		challenge, err := signMFAToken(user)
+		if err != nil {
+			return LoginUserOutput{}, err
+		}
+		return LoginUserOutput{MFA: challenge}, nil
+	}
+
+	tokens, err := CreateSession(user, input.Client)
 	if err != nil {
 		return LoginUserOutput{}, err
 	}
 
 	return LoginUserOutput{
-		User:      *user,
-		AuthToken: signedToken,
+		User:       *user,
+		AuthTokens: *tokens,
 	}, nil
 }
 
@@ -513,6 +581,7 @@ func (f *UserFunc) LoginHandler(ctx *gin.Context) {
 		})
 		return
 	}
+	input.Client = NewSessionClient(ctx)
 
 	loginOut, err := f.LoginFunc(input)
 	if err != nil {
@@ -533,6 +602,15 @@ func (f *UserFunc) LoginHandler(ctx *gin.Context) {
 			return
 		}
 
+		if err == ErrAccountNotConfirmed {
+			ctx.JSON(403, gin.H{
+				"status":  "error",
+				"code":    "account_not_confirmed",
+				"message": "Your account isn't confirmed yet, please check your email to confirm your account",
+			})
+			return
+		}
+
 		ctx.JSON(422, gin.H{
 			"status":  "error",
 			"message": "User authentication failed, not authorized",
@@ -540,6 +618,15 @@ func (f *UserFunc) LoginHandler(ctx *gin.Context) {
 		return
 	}
 
+	if loginOut.MFA != nil {
+		ctx.JSON(200, gin.H{
+			"status":  "success",
+			"message": "Second factor is required, please enter the code of your authenticator app",
+			"data":    loginOut.MFA,
+		})
+		return
+	}
+
 	ctx.JSON(200, gin.H{
 		"status":  "success",
 		"message": "User authenticated",
@@ -1,13 +1,27 @@
 package api
 
-import "math/rand"
+import (
+	"crypto/rand"
+	"encoding/base64"
+	mathrand "math/rand"
+)
 
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func GenRandString(length int) string {
 	r := make([]rune, length)
 	for i := range r {
-		r[i] = letters[rand.Intn(len(letters))]
+		r[i] = letters[mathrand.Intn(len(letters))]
 	}
 	return string(r)
 }
+
+// GenSecureToken returns a url safe random token for secrets like refresh
+// tokens, it reads length bytes from crypto/rand.
+func GenSecureToken(length int) string {
+	b := make([]byte, length)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
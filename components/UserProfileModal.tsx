@@ -3,7 +3,7 @@ import { useState, useEffect, ChangeEvent } from "react";
 import { useForm, SubmitHandler } from "react-hook-form";
 import { useRouter } from "next/router";
 import Image from "next/image";
-import http from "../lib/http";
+import http, { clearAuthTokens } from "../lib/http";
 
 type UpdateUserInput = {
   firstName?: string;
@@ -95,9 +95,14 @@ const UserProfileModal = ({ openUserProfileModal }: any) => {
     setIsPasswordVisible((prevValue) => !prevValue);
   };
 
-  const onUserLogout = (event: any) => {
+  const onUserLogout = async (event: any) => {
     event.preventDefault();
-    localStorage.removeItem("talkbox");
+    try {
+      await http.post("/auth/logout");
+    } catch (e) {
+      console.error(e);
+    }
+    clearAuthTokens();
     router.push("/");
   };
 
@@ -4,6 +4,63 @@ const http = axios.create({
   baseURL: `${process.env.NEXT_PUBLIC_API_BASE_URL}/api/v1`,
 });
 
+export const saveAuthTokens = (tokens: any) => {
+  localStorage.setItem("talkbox", tokens?.authToken);
+  localStorage.setItem("talkbox_refresh", tokens?.refreshToken);
+};
+
+export const clearAuthTokens = () => {
+  localStorage.removeItem("talkbox");
+  localStorage.removeItem("talkbox_refresh");
+};
+
+// refresh tokens rotate on every use, so concurrent requests share a single
+// refresh instead of racing each other with the same token
+let refreshing: Promise<string> | null = null;
+
+export const refreshAuthToken = () => {
+  if (!refreshing) {
+    refreshing = (async () => {
+      const refreshToken = localStorage.getItem("talkbox_refresh");
+      if (!refreshToken) {
+        throw new Error("Missing refresh token");
+      }
+
+      try {
+        const response = await axios.post(
+          `${process.env.NEXT_PUBLIC_API_BASE_URL}/api/v1/auth/refresh`,
+          { refreshToken }
+        );
+        saveAuthTokens(response.data?.data);
+        return response.data?.data?.authToken;
+      } catch (err) {
+        clearAuthTokens();
+        throw err;
+      }
+    })().finally(() => {
+      refreshing = null;
+    });
+  }
+
+  return refreshing;
+};
+
+// the websocket can't retry with a new token, so it asks for a token that
+// won't expire while connecting
+export const getFreshAuthToken = async () => {
+  const token = localStorage.getItem("talkbox");
+  if (token) {
+    const claims = JSON.parse(
+      Buffer.from(token.split(".")[1], "base64").toString()
+    );
+    if (claims.exp * 1000 > Date.now() + 30 * 1000) {
+      return token;
+    }
+  }
+
+  return refreshAuthToken();
+};
+
 http.interceptors.request.use((config) => {
   const token = localStorage.getItem("talkbox");
   if (token && config.headers) {
@@ -12,4 +69,22 @@ http.interceptors.request.use((config) => {
   return config;
 });
 
+http.interceptors.response.use(undefined, async (err) => {
+  const config = err.config;
+  // the auth routes answer 401 for their own tokens, a refresh can't help
+  if (
+    err.response?.status !== 401 ||
+    !config ||
+    config._retried ||
+    config.url?.startsWith("/auth/")
+  ) {
+    throw err;
+  }
+
+  config._retried = true;
+  const token = await refreshAuthToken();
+  config.headers["Authorization"] = `Bearer ${token}`;
+  return http(config);
+});
+
 export default http;
@@ -5,7 +5,7 @@ import { useEffect, useState, useRef, useContext } from "react";
 import type { NextPageWithLayout } from "../_app";
 import type { ReactElement } from "react";
 import InboxesLayout, { RoomContext } from "./_layout";
-import http from "../../lib/http";
+import http, { getFreshAuthToken } from "../../lib/http";
 import useCurrentUser from "../../hook/useCurrentUser";
 
 type SendMessageInput = {
@@ -26,16 +26,24 @@ const Inboxes: NextPageWithLayout<any> = () => {
   useEffect(() => {
     if (router.isReady) {
       const { roomId } = router.query;
-      const authToken = localStorage.getItem("talkbox");
-      const url = `${process.env.NEXT_PUBLIC_WS_BASE_URL}/rooms/${roomId}?authToken=${authToken}`;
       let ws: any;
-      if (typeof window !== "undefined") {
-        ws = new WebSocket(url);
-        setWsInstance(ws);
-      }
+      let closed = false;
+      (async () => {
+        try {
+          const authToken = await getFreshAuthToken();
+          const url = `${process.env.NEXT_PUBLIC_WS_BASE_URL}/rooms/${roomId}?authToken=${authToken}`;
+          if (!closed && typeof window !== "undefined") {
+            ws = new WebSocket(url);
+            setWsInstance(ws);
+          }
+        } catch (e) {
+          router.push("/");
+        }
+      })();
 
       return () => {
-        if (ws?.readyState !== 3) {
+        closed = true;
+        if (ws && ws.readyState !== 3) {
           ws.close();
         }
       };
@@ -76,13 +84,25 @@ const Inboxes: NextPageWithLayout<any> = () => {
     if (wsInstance) {
       wsInstance.onmessage = (event: MessageEvent) => {
         const response = JSON.parse(event.data);
-        setMessages((prevMessages: any) => [response, ...prevMessages]);
+        if (response.type === "message.created") {
+          setMessages((prevMessages: any) => [
+            response.payload,
+            ...prevMessages,
+          ]);
+        }
       };
     }
   }, [wsInstance]);
 
   const onSubmitMessage: SubmitHandler<SendMessageInput> = (data) => {
-    wsInstance?.send(JSON.stringify(data));
+    wsInstance?.send(
+      JSON.stringify({
+        v: 1,
+        type: "message.send",
+        nonce: crypto.randomUUID(),
+        payload: data,
+      })
+    );
     setIsFetchingRooms(true);
   };
 
@@ -15,6 +15,36 @@ import NewMessageModal from "../../components/NewMessageModal";
 
 export const RoomContext = createContext<any>({});
 
+const attachmentLabels: Record<string, string> = {
+  image: "📎 photo",
+  video: "📎 video",
+  audio: "📎 audio",
+  file: "📎 file",
+};
+
+function formatRelativeTime(date: string) {
+  const seconds = Math.floor((Date.now() - new Date(date).getTime()) / 1000);
+  if (seconds < 60) return "now";
+  if (seconds < 60 * 60) return `${Math.floor(seconds / 60)}m`;
+  if (seconds < 60 * 60 * 24) return `${Math.floor(seconds / (60 * 60))}h`;
+  if (seconds < 60 * 60 * 24 * 7)
+    return `${Math.floor(seconds / (60 * 60 * 24))}d`;
+
+  return new Date(date).toLocaleDateString("en-us", { dateStyle: "short" });
+}
+
+function formatLastMessage(lastMessage: any, currentUserId?: string) {
+  if (!lastMessage) return "";
+
+  const content =
+    lastMessage.body || attachmentLabels[lastMessage.attachmentType] || "";
+  if (!lastMessage.senderId) return content;
+
+  const sender =
+    lastMessage.senderId === currentUserId ? "You" : lastMessage.senderName;
+  return sender ? `${sender}: ${content}` : content;
+}
+
 export default function InboxesLayout({ children }: { children: any }) {
   const router = useRouter();
   const [rooms, setRooms] = useState<any>([]);
@@ -124,11 +154,8 @@ export default function InboxesLayout({ children }: { children: any }) {
             <ul id="inbox-list" className="flex flex-col mt-2 divide-y">
               {rooms.map(
                 ({ participants, id, lastMessage, updatedAt }: any) => {
-                  const timestamp = new Date(updatedAt).toLocaleTimeString(
-                    "en-us",
-                    {
-                      timeStyle: "short",
-                    }
+                  const timestamp = formatRelativeTime(
+                    lastMessage?.id ? lastMessage.createdAt : updatedAt
                   );
                   const friends = participants?.filter(
                     (participant: any) => participant?.id !== currentUser?.id
@@ -156,7 +183,7 @@ export default function InboxesLayout({ children }: { children: any }) {
                               {friends[0]?.username}
                             </p>
                             <p className="font-sans text-slate-400 text-sm">
-                              {lastMessage}
+                              {formatLastMessage(lastMessage, currentUser?.id)}
                             </p>
                           </div>
 
@@ -1,7 +1,7 @@
 import { useState } from "react";
 import { SubmitHandler, useForm } from "react-hook-form";
 import Link from "next/link";
-import http from "../lib/http";
+import http, { saveAuthTokens } from "../lib/http";
 import { AxiosError } from "axios";
 import { useRouter } from "next/router";
 import useCurrentUser from "../hook/useCurrentUser";
@@ -11,6 +11,10 @@ type UserLoginInput = {
   password: string;
 };
 
+type VerifyMFAInput = {
+  code: string;
+};
+
 type UserLoginErrorOutput = {
   status?: string;
   message?: string;
@@ -19,13 +23,21 @@ type UserLoginErrorOutput = {
 export default function Home() {
   const [errorResponse, setErrorResponse] = useState<UserLoginErrorOutput>();
   const { register, handleSubmit } = useForm<UserLoginInput>();
+  const { register: registerMFA, handleSubmit: handleSubmitMFA } =
+    useForm<VerifyMFAInput>();
+  const [mfaToken, setMFAToken] = useState<string>();
   const router = useRouter();
   useCurrentUser();
 
   const onSubmitLogin: SubmitHandler<UserLoginInput> = async (data) => {
     try {
       const response = await http.post("/auth/login", data);
-      localStorage.setItem("talkbox", response.data?.data?.authToken);
+      if (response.data?.data?.mfaRequired) {
+        setErrorResponse(undefined);
+        setMFAToken(response.data?.data?.mfaToken);
+        return;
+      }
+      saveAuthTokens(response.data?.data);
       router.push("/inboxes");
     } catch (err) {
       if (err instanceof AxiosError) {
@@ -35,6 +47,64 @@ export default function Home() {
     }
   };
 
+  // the code field also takes a recovery code, those contain a dash
+  const onSubmitMFA: SubmitHandler<VerifyMFAInput> = async ({ code }) => {
+    const input = code.includes("-")
+      ? { mfaToken, recoveryCode: code }
+      : { mfaToken, code };
+    try {
+      const response = await http.post("/auth/login/mfa", input);
+      saveAuthTokens(response.data?.data);
+      router.push("/inboxes");
+    } catch (err) {
+      if (err instanceof AxiosError) {
+        if (err.response?.status === 401) {
+          setMFAToken(undefined);
+        }
+        setErrorResponse(err.response?.data);
+      }
+    }
+  };
+
+  if (mfaToken) {
+    return (
+      <main className="container mx-auto">
+        <div className="flex flex-col justify-center items-center min-h-screen">
+          <form
+            onSubmit={handleSubmitMFA(onSubmitMFA)}
+            className="w-1/2 lg:w-1/4 flex flex-col gap-3"
+          >
+            <div className="flex bg-rose-400 text-white">
+              <p>{errorResponse?.message}</p>
+            </div>
+            <div className="flex flex-col gap-2">
+              <label htmlFor="code" className="text-slate-500">
+                Authentication code
+              </label>
+              <div className="flex flex-col gap-1">
+                <input
+                  {...registerMFA("code")}
+                  id="code"
+                  type="text"
+                  autoComplete="one-time-code"
+                  className="w-full rounded-md border-slate-300 bg-white"
+                  placeholder="Enter the code of your authenticator app or a recovery code..."
+                />
+              </div>
+            </div>
+
+            <button
+              type="submit"
+              className="w-full text-center bg-indigo-500 text-white font-medium rounded-md py-2 hover:bg-indigo-700 hover:cursor-pointer"
+            >
+              Verify
+            </button>
+          </form>
+        </div>
+      </main>
+    );
+  }
+
   return (
     <main className="container mx-auto">
       <div className="flex flex-col justify-center items-center min-h-screen">